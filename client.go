@@ -2,146 +2,688 @@ package websocket
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
 	"errors"
+	"io"
 	"net"
-	"unsafe"
-
-	"github.com/valyala/fasthttp"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
 )
 
 var (
 	// ErrCannotUpgrade shows up when an error occurred when upgrading a connection.
 	ErrCannotUpgrade = errors.New("cannot upgrade connection")
+
+	// ErrClientStarted shows up when reading on the client after Start, the messages go to the handlers
+	ErrClientStarted = errors.New("websocket: client is started, the messages go to the handlers")
 )
 
+// Client is the connection to a websocket server, it is not safe for concurrent
+// use unless it is started by Start
 type Client struct {
+	// DisableUTF8Validation skip the UTF-8 check of the text message and the close reason
+	DisableUTF8Validation bool
+
+	// ReadLimit is the max size in bytes of a frame or a reassembled message from the
+	// server, the connection is closed with 1009 when it is over. Default is 32 MB,
+	// a negative value means no limit
+	ReadLimit int64
+
+	// CloseTimeout is how long Close waits the close frame from the server, default is 5 seconds
+	CloseTimeout time.Duration
+
+	// CompressionLevel is the flate level of the compressed messages when the server
+	// accepts permessage-deflate, default is flate.BestSpeed. It must be set before
+	// the first message is written
+	CompressionLevel int
+
+	// CompressionThreshold is the min size of the data message compressed by WriteMessage,
+	// the smaller message is sent uncompressed
+	CompressionThreshold int
+
+	closeSent bool
+
+	// closeReceived is set when the close frame from the server is received
+	closeReceived bool
+
+	// closeErr is the close frame from the server, it is returned by the reads after close
+	closeErr *CloseError
+
 	c        net.Conn
 	rwBuffer *bufio.ReadWriter
+
+	reader frameReader
+
+	// message reassemble the fragmented data frames across Read calls
+	message messageBuffer
+
+	// nextReader is the message reader returned by the last NextReader
+	nextReader nextReader
+
+	// compressor is set when the server accepts permessage-deflate
+	compressor *compressor
+
+	messageHandler MessageHandler
+	pingHandler    PingHandler
+	pongHandler    PongHandler
+	closeHandler   CloseHandler
+
+	// responseHeader is the header of the 101 response of the server
+	responseHeader http.Header
+
+	// url is the url of the server after the redirects
+	url *url.URL
+
+	subprotocol string
+
+	// conn is the goroutine safe connection of the client after Start, done is closed when it ends
+	conn *Conn
+	done chan struct{}
 }
 
+// NewClient connect to the websocket server of the url by the DefaultDialer
 func NewClient(url string) (*Client, error) {
+	return DefaultDialer.Dial(url, nil)
+}
+
+// NewClientConn make the client of the connection which already finished the opening
+// handshake, like a Unix socket or a net.Pipe. The io.ReadWriteCloser which is not a
+// net.Conn has no deadline, so Close waits the close frame of the server without timeout
+func NewClientConn(c io.ReadWriteCloser) *Client {
+	conn := toNetConn(c)
+
+	br := bufio.NewReader(conn)
 
-	uri := fasthttp.AcquireURI()
-	req := fasthttp.AcquireRequest()
-	resp := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseURI(uri)
-	defer fasthttp.ReleaseRequest(req)
-	defer fasthttp.ReleaseResponse(resp)
+	return &Client{
+		c:        conn,
+		rwBuffer: bufio.NewReadWriter(br, bufio.NewWriter(conn)),
+		reader:   frameReader{chunkSize: int64(br.Size())},
+	}
+}
 
-	uri.Update(url)
+// SetMessageHandler set the handler of the messages from the server after Start
+func (c *Client) SetMessageHandler(messageHandler MessageHandler) {
+	c.messageHandler = messageHandler
+}
 
-	uri.SetScheme("http")
+// SetPingHandler replace the default handler answering the ping with a pong after Start
+func (c *Client) SetPingHandler(pingHandler PingHandler) {
+	c.pingHandler = pingHandler
+}
 
-	addr := make([]byte, 0)
+// SetPongHandler set the handler of the pongs from the server after Start
+func (c *Client) SetPongHandler(pongHandler PongHandler) {
+	c.pongHandler = pongHandler
+}
+
+// OnClose set the handler called once when the connection ends after Start
+func (c *Client) OnClose(closeHandler CloseHandler) {
+	c.closeHandler = closeHandler
+}
 
-	addr = append(addr[:0], uri.Host()...)
-	if n := bytes.LastIndexByte(addr, ':'); n == -1 {
-		addr = append(addr, []byte(":80")...)
+// Start run the read loop of the client in the background like the Server does, the
+// messages go to the MessageHandler and the pings are answered unless the PingHandler
+// is set. The writes are queued and safe for concurrent use after Start, Read and
+// NextReader cannot be used any more. The handlers must be set before Start
+func (c *Client) Start() error {
+	if c.conn != nil {
+		return ErrClientStarted
 	}
 
-	c, err := net.Dial("tcp", *(*string)(unsafe.Pointer(&addr)))
+	if err := c.writeErr(); err != nil {
+		return err
+	}
 
-	if err != nil {
-		return nil, err
+	if err := c.discardNextReader(); err != nil {
+		return err
 	}
 
-	req.Header.SetMethod("GET")
-	req.Header.AddBytesKV(connectionString, upgradeString)
-	req.Header.AddBytesKV(upgradeString, webSocketString)
-	req.Header.AddBytesKV(websocketVersionString, websocketAcceptVersionString)
-	req.Header.AddBytesKV(websocketKeyString, secWebsocketKeyValueString)
+	config := connConfig{
+		isServer:     false,
+		validateUTF8: !c.DisableUTF8Validation,
+		closeTimeout: c.CloseTimeout,
+		readLimit:    c.ReadLimit,
+		pingHandler:  c.pingHandler,
+		pongHandler:  c.pongHandler,
+		bufferReader: c.rwBuffer.Reader,
+		bufferWriter: c.rwBuffer.Writer,
+		subprotocol:  c.subprotocol,
+	}
 
-	req.SetRequestURIBytes(uri.FullURI())
+	if config.readLimit == 0 {
+		config.readLimit = defaultReadLimit
+	}
 
-	br := bufio.NewReader(c)
-	bw := bufio.NewWriter(c)
-	req.Write(bw)
-	bw.Flush()
+	if config.closeTimeout <= 0 {
+		config.closeTimeout = defaultCloseTimeout
+	}
 
-	if err := resp.Read(br); err != nil {
-		return nil, err
+	// the history of the compressed messages goes on in the conn
+	if c.compressor != nil {
+		c.compressor.level = compressionLevel(c.CompressionLevel)
+
+		config.compression = &compressionOptions{
+			threshold:    c.CompressionThreshold,
+			compressor:   c.compressor,
+			decompressor: c.message.decompressor,
+		}
 	}
 
-	if resp.StatusCode() != fasthttp.StatusSwitchingProtocols {
-		return nil, ErrCannotUpgrade
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.conn = newConn(ctx, c.c, cancel, config)
+	c.done = make(chan struct{})
+
+	go c.serve()
+
+	return nil
+}
+
+// serve deliver the messages of the started client to the handlers until the connection ends
+func (c *Client) serve() {
+	defer close(c.done)
+
+	c.conn.messageLoop(c.messageHandler)
+
+	c.conn.shutdown(func(frame *Frame) {
+		c.conn.dataFrameHandler(c.messageHandler, frame)
+	})
+
+	if c.closeHandler != nil {
+		closeErr := c.conn.closeStatus()
+		c.closeHandler(c.conn, closeErr.Code, closeErr.Text)
 	}
+}
+
+// ConnectionState return the state of the TLS connection, ok is false when the url is not wss
+func (c *Client) ConnectionState() (state tls.ConnectionState, ok bool) {
+	tlsConn, ok := c.c.(*tls.Conn)
 
-	websocketConn := &Client{
-		c:        c,
-		rwBuffer: bufio.NewReadWriter(br, bw),
+	if !ok {
+		return tls.ConnectionState{}, false
 	}
 
-	return websocketConn, nil
+	return tlsConn.ConnectionState(), true
+}
+
+// URL return the url of the server the client is connected to, it is the location of
+// the last redirect when the opening handshake was redirected
+func (c *Client) URL() *url.URL {
+	return c.url
+}
+
+// Subprotocol return the Sec-WebSocket-Protocol selected by the server, it is empty when none is selected
+func (c *Client) Subprotocol() string {
+	return c.subprotocol
+}
+
+// ResponseHeader return the header of the 101 response of the server like the
+// accepted extensions and the Set-Cookie values
+func (c *Client) ResponseHeader() http.Header {
+	return c.responseHeader
 }
 
+// enableCompression set up the compressor and the decompressor by the parameters accepted by the server
+func (c *Client) enableCompression(params *compressionParams) {
+	c.reader.compression = true
+	c.message.decompressor = &decompressor{noContextTakeover: params.serverNoContextTakeover}
+	c.compressor = &compressor{noContextTakeover: params.clientNoContextTakeover}
+}
+
+// Write send p as a text message
 func (c *Client) Write(p []byte) error {
+	return c.WriteMessage(TextMessage, p)
+}
+
+// WriteText send data as a text message
+func (c *Client) WriteText(data []byte) error {
+	return c.WriteMessage(TextMessage, data)
+}
+
+// WriteBinary send data as a binary message
+func (c *Client) WriteBinary(data []byte) error {
+	return c.WriteMessage(BinaryMessage, data)
+}
+
+// WriteMessage send data as a single frame message of the message type, data
+// is copied before masking so the caller's slice is left untouched. The data message
+// is compressed when the server accepts permessage-deflate and it is not below the
+// CompressionThreshold
+func (c *Client) WriteMessage(messageType FrameTypeCode, data []byte) error {
+	return c.writeMessage(messageType, data, len(data) >= c.CompressionThreshold)
+}
+
+// WriteMessageWithCompression is WriteMessage but compress tells the data message is
+// compressed or not whatever its size, it is never compressed without permessage-deflate
+func (c *Client) WriteMessageWithCompression(messageType FrameTypeCode, data []byte, compress bool) error {
+	return c.writeMessage(messageType, data, compress)
+}
+
+func (c *Client) writeMessage(messageType FrameTypeCode, data []byte, compress bool) error {
+	if c.conn != nil {
+		return c.conn.writeMessage(messageType, data, compress)
+	}
+
+	if err := checkMessage(messageType, data); err != nil {
+		return err
+	}
+
+	compress = compress && c.compressor != nil && (messageType == TextMessage || messageType == BinaryMessage)
+
+	if compress {
+		if err := c.writeErr(); err != nil {
+			return err
+		}
+
+		c.compressor.level = compressionLevel(c.CompressionLevel)
+
+		payload, err := c.compressor.compress(data)
+
+		if err != nil {
+			return err
+		}
+
+		data = payload
+	}
+
+	return c.sendFrame(messageType, data, true, compress)
+}
+
+// NextWriter return a writer of a message of the message type, the data written is
+// sent in frames of the write buffer size and the last frame is sent by Close. The
+// message is compressed when the server accepts permessage-deflate
+func (c *Client) NextWriter(messageType FrameTypeCode) (io.WriteCloser, error) {
+	if c.conn != nil {
+		return c.conn.NextWriter(messageType)
+	}
+
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, ErrInvalidMessageType
+	}
+
+	if err := c.writeErr(); err != nil {
+		return nil, err
+	}
+
+	w := newMessageWriter(c, messageType, c.rwBuffer.Writer.Size())
+
+	if c.compressor == nil {
+		return w, nil
+	}
+
+	c.compressor.level = compressionLevel(c.CompressionLevel)
+
+	cw, err := newCompressedWriter(w, c.compressor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cw, nil
+}
+
+func (c *Client) sendFrame(frameType FrameTypeCode, payload []byte, isFin bool, compressed bool) error {
 	var err error
 
+	if err = c.writeErr(); err != nil {
+		return err
+	}
+
 	frame := AcquireFrame()
 	defer ReleaseFrame(frame)
 
-	frame.SetFin()
-	frame.SetFrameType(codeText)
-	frame.SetPayload(p)
-	frame.SetPayloadSize(int64(len(p)))
+	if isFin {
+		frame.SetFin()
+	}
+
+	frame.SetFrameType(frameType)
+	frame.SetPayload(append(frame.payload[:0], payload...))
+	frame.SetPayloadSize(int64(len(payload)))
 	frame.SetMask()
+	frame.rsv1 = compressed
 
 	if _, err = frame.WriteTo(c.rwBuffer); err == nil {
-		c.rwBuffer.Flush()
+		err = c.rwBuffer.Flush()
+	}
+
+	// the frame may be half written, the connection cannot be used after the write error
+	if err != nil {
+		c.c.Close()
+		c.closeErr = &CloseError{Code: WebsocketStatusCodeAbnormalClosure}
 	}
 
 	return err
 }
 
-func (c *Client) Read() (frameTypeCode, []byte, error) {
-	newFrame := newFrame()
+func (c *Client) endMessage() {}
+
+// writeErr return the error of writing after the close handshake started
+func (c *Client) writeErr() error {
+	if c.closeErr != nil {
+		return c.closeErr
+	}
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	return nil
+}
+
+// Read return the next ping or pong frame or the next complete data message,
+// the fragmented data frames are reassembled before return. The ping is answered
+// with a pong of the same payload before return. The close frame from the server
+// is answered and returned as *CloseError, so are the reads after it
+func (c *Client) Read() (FrameTypeCode, []byte, error) {
+	if c.conn != nil {
+		return codeUnknown, nil, ErrClientStarted
+	}
+
+	if err := c.discardNextReader(); err != nil {
+		return codeUnknown, nil, err
+	}
+
+	for {
+		newFrame, err := c.nextFrame()
+
+		if err != nil {
+			return codeUnknown, nil, err
+		}
 
-	if _, err := newFrame.ReadFrom(c.rwBuffer); err != nil {
+		// control frame can be injected in the middle of a fragmented message
+		if newFrame.IsControl() {
+			return newFrame.GetFrameType(), newFrame.GetPayload(), nil
+		}
+
+		complete, err := c.message.push(newFrame)
+
+		if err != nil {
+			c.message.reset()
+			c.fail(err)
+			return codeUnknown, nil, err
+		}
+
+		if complete {
+			frameType, payload := c.message.take()
+			return frameType, payload, nil
+		}
+	}
+}
+
+// NextReader return the type and the reader of the next data message, the frames of
+// the message are read as they arrive so the message is never fully buffered. The
+// rest of the previous message is dropped, the pings on the way are answered
+func (c *Client) NextReader() (FrameTypeCode, io.Reader, error) {
+	if c.conn != nil {
+		return codeUnknown, nil, ErrClientStarted
+	}
+
+	if err := c.discardNextReader(); err != nil {
 		return codeUnknown, nil, err
 	}
 
-	return newFrame.GetFrameType(), newFrame.GetPayload(), nil
+	frame, err := c.nextDataFrame()
+
+	if err != nil {
+		return codeUnknown, nil, err
+	}
+
+	frameType := frame.frameType
+
+	r, err := newNextReader(c, frame, &c.message)
+
+	if err != nil {
+		return codeUnknown, nil, err
+	}
+
+	c.nextReader = r
+
+	return frameType, r, nil
 }
 
-func (c *Client) Close() (frameTypeCode, websocketStatusCode, error) {
+func (c *Client) discardNextReader() error {
+	if c.nextReader == nil {
+		return nil
+	}
 
-	frame := AcquireFrame()
-	defer ReleaseFrame(frame)
+	r := c.nextReader
+	c.nextReader = nil
 
-	frame.SetFin()
-	frame.SetFrameType(codeClose)
-	frame.SetStatus(websocketStatusCodeNormalClosure)
+	return r.discard()
+}
 
-	if _, err := frame.WriteTo(c.rwBuffer); err == nil {
-		c.rwBuffer.Flush()
-	} else {
-		return codeUnknown, 0, err
+// nextFrame read the next frame from the server, the ping is answered, the close frame
+// is answered and returned as *CloseError, the frame breaking the rules fail the connection
+func (c *Client) nextFrame() (*Frame, error) {
+	if c.closeErr != nil {
+		return nil, c.closeErr
 	}
 
-	frameType, payload, _ := c.Read()
+	c.message.validateUTF8 = !c.DisableUTF8Validation
+	c.reader.readLimit = c.ReadLimit
 
-	c.c.Close()
+	if c.reader.readLimit == 0 {
+		c.reader.readLimit = defaultReadLimit
+	}
+
+	c.message.readLimit = c.reader.readLimit
+
+	newFrame := newFrame()
+
+	if err := c.reader.read(c.rwBuffer, newFrame); err != nil {
+		if isFailure(err) {
+			c.fail(err)
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the server is gone without close frame
+			c.closeErr = &CloseError{Code: WebsocketStatusCodeAbnormalClosure}
+			return nil, c.closeErr
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			// the frame may be half read, the connection cannot be used after the timeout
+			if !c.closeSent {
+				c.writeClose(WebsocketStatusCodeGoingAway, "read timeout")
+			}
+
+			c.c.Close()
+			c.closeErr = &CloseError{Code: WebsocketStatusCodeAbnormalClosure}
+		}
+
+		return nil, err
+	}
+
+	if newFrame.IsClose() {
+		closeErr, err := parseCloseFrame(newFrame, !c.DisableUTF8Validation)
+
+		if err != nil {
+			c.fail(err)
+			return nil, err
+		}
+
+		c.closeErr = closeErr
+		c.closeReceived = true
+
+		// echo the status code of the server back when the server closed first
+		if !c.closeSent {
+			c.writeClose(closeErr.Code, "")
+		}
 
-	status := websocketStatusCode(binary.BigEndian.Uint16(payload))
+		c.c.Close()
 
-	return frameType, status, nil
+		return nil, closeErr
+	}
+
+	// the ping is answered with the same payload, nothing is sent after the close frame
+	if newFrame.IsPing() && !c.closeSent {
+		if err := c.Pong(newFrame.payload); err != nil {
+			return nil, err
+		}
+	}
+
+	return newFrame, nil
 }
 
-func (c *Client) Ping() error {
+// nextDataFrame return the next data frame, the pings before it are answered
+func (c *Client) nextDataFrame() (*Frame, error) {
+	for {
+		frame, err := c.nextFrame()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !frame.IsControl() {
+			return frame, nil
+		}
+	}
+}
+
+// Close start the close handshake with WebsocketStatusCodeNormalClosure
+func (c *Client) Close() error {
+	return c.CloseWithReason(WebsocketStatusCodeNormalClosure, "")
+}
+
+// CloseWithReason send the close frame with the status code and the reason and wait
+// the close frame from the server, the data frames before it are dropped. The
+// connection is force closed when the server does not answer in the close timeout,
+// it return nil when the server closed first and its close frame is answered
+func (c *Client) CloseWithReason(code WebsocketStatusCode, reason string) error {
+	if !code.isValid() {
+		return ErrCloseCodeNotAllowed
+	}
+
+	if len(reason) > maxCloseReasonSize {
+		return ErrCloseReasonTooLong
+	}
+
+	if c.conn != nil {
+		return c.closeStarted(code, reason)
+	}
+
+	// the server closed first and its close frame is already answered
+	if c.closeReceived {
+		return nil
+	}
+
+	if err := c.writeErr(); err != nil {
+		return err
+	}
+
+	if err := c.writeClose(code, reason); err != nil {
+		c.c.Close()
+		return err
+	}
+
+	timeout := c.CloseTimeout
+
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+
+	c.c.SetReadDeadline(time.Now().Add(timeout))
 
 	var err error
 
+	for err == nil {
+		_, _, err = c.Read()
+	}
+
+	c.c.Close()
+
+	if _, ok := err.(*CloseError); ok {
+		return nil
+	}
+
+	// the server never answered the close frame
+	c.closeErr = &CloseError{Code: WebsocketStatusCodeAbnormalClosure}
+
+	return err
+}
+
+// closeStarted close the started client and wait the connection ends
+func (c *Client) closeStarted(code WebsocketStatusCode, reason string) error {
+	// the close frame is already sent when the server closed first
+	if err := c.conn.CloseWithReason(code, reason); err != nil && err != ErrCloseSent {
+		return err
+	}
+
+	<-c.done
+
+	// the server never answered the close frame
+	if closeErr := c.conn.closeError(); closeErr == nil || closeErr.Code == WebsocketStatusCodeAbnormalClosure {
+		return &CloseError{Code: WebsocketStatusCodeAbnormalClosure}
+	}
+
+	return nil
+}
+
+func (c *Client) writeClose(code WebsocketStatusCode, reason string) error {
+	c.closeSent = true
+
 	frame := AcquireFrame()
 	defer ReleaseFrame(frame)
 
 	frame.SetFin()
-	frame.SetFrameType(codePing)
+	frame.SetFrameType(codeClose)
+	frame.SetCloseReason(code, reason)
+	frame.SetMask()
 
-	if _, err = frame.WriteTo(c.rwBuffer); err == nil {
-		c.rwBuffer.Flush()
+	_, err := frame.WriteTo(c.rwBuffer)
+
+	if err == nil {
+		err = c.rwBuffer.Flush()
 	}
 
 	return err
 }
+
+// SetReadDeadline set the deadline of the reads, the connection is closed when a read
+// times out since the frame may be half read. A zero value means no deadline
+func (c *Client) SetReadDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+
+	return c.c.SetReadDeadline(t)
+}
+
+// SetWriteDeadline set the deadline of the writes, the connection is closed when a write
+// times out since the frame may be half written. A zero value means no deadline
+func (c *Client) SetWriteDeadline(t time.Time) error {
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+
+	return c.c.SetWriteDeadline(t)
+}
+
+func (c *Client) fail(err error) {
+	c.failConnection(statusForError(err))
+}
+
+// failConnection send the close frame with the status and close the connection
+// without waiting the close frame from the server, the reads and the writes after
+// it return the status as *CloseError
+func (c *Client) failConnection(status WebsocketStatusCode) {
+	if c.closeErr == nil {
+		c.closeErr = &CloseError{Code: status}
+	}
+
+	// only one close frame is sent on the connection
+	if !c.closeSent {
+		c.writeClose(status, "")
+	}
+
+	c.c.Close()
+}
+
+// Ping send a ping without payload
+func (c *Client) Ping() error {
+	return c.WriteMessage(PingMessage, nil)
+}
+
+// Pong send a pong, data should be the payload of the ping it answers
+func (c *Client) Pong(data []byte) error {
+	return c.WriteMessage(PongMessage, data)
+}
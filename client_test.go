@@ -0,0 +1,201 @@
+package websocket
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_ClientStart(t *testing.T) {
+	var pongs atomic.Int64
+
+	wsServer := &Server{
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  5 * time.Second,
+	}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.WriteText(data)
+	})
+
+	wsServer.SetPongHandler(func(c *Conn, data []byte) {
+		pongs.Add(1)
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, messages = 20, 50
+
+	received := make(chan string, writers*messages)
+	closed := make(chan WebsocketStatusCode, 2)
+
+	client.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		received <- string(data)
+	})
+
+	client.OnClose(func(c *Conn, code WebsocketStatusCode, reason string) {
+		closed <- code
+	})
+
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.Read(); err != ErrClientStarted {
+		t.Errorf("expected %v, got %v", ErrClientStarted, err)
+	}
+
+	// many goroutines send on the same client
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < messages; j++ {
+				if err := client.WriteText([]byte(strconv.Itoa(i*messages + j))); err != nil {
+					t.Error(err)
+					return
+				}
+
+				client.Ping()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	seen := map[string]bool{}
+
+	for len(seen) < writers*messages {
+		select {
+		case data := <-received:
+			seen[data] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d messages", len(seen), writers*messages)
+		}
+	}
+
+	// the pings of the server are answered by the read loop
+	for deadline := time.Now().Add(5 * time.Second); pongs.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the client never answered the ping")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := <-closed; code != WebsocketStatusCodeNormalClosure {
+		t.Errorf("expected %d, got %d", WebsocketStatusCodeNormalClosure, code)
+	}
+
+	if len(closed) != 0 {
+		t.Error("the close handler should be called once")
+	}
+
+	if err := client.WriteText([]byte("after close")); err == nil {
+		t.Error("write after close should fail")
+	}
+}
+
+func Test_ClientStartServerClose(t *testing.T) {
+	wsServer := &Server{}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.CloseWithReason(WebsocketStatusCodeGoingAway, string(data))
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type closeEvent struct {
+		code   WebsocketStatusCode
+		reason string
+	}
+
+	closed := make(chan closeEvent, 1)
+
+	client.OnClose(func(c *Conn, code WebsocketStatusCode, reason string) {
+		closed <- closeEvent{code, reason}
+	})
+
+	client.Start()
+	client.WriteText([]byte("restart"))
+
+	select {
+	case event := <-closed:
+		if event.code != WebsocketStatusCodeGoingAway || event.reason != "restart" {
+			t.Errorf("unexpected close %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the close handler was not called")
+	}
+}
+
+func Test_ClientConnPipe(t *testing.T) {
+	wsServer := newEchoTestServer()
+
+	// readWriteCloser hide the net.Conn methods of the pipe
+	type readWriteCloser struct{ io.ReadWriteCloser }
+
+	for _, tc := range []struct {
+		name   string
+		server func(c net.Conn) io.ReadWriteCloser
+		client func(c net.Conn) io.ReadWriteCloser
+	}{
+		{
+			name:   "net.Conn",
+			server: func(c net.Conn) io.ReadWriteCloser { return c },
+			client: func(c net.Conn) io.ReadWriteCloser { return c },
+		},
+		{
+			name:   "io.ReadWriteCloser",
+			server: func(c net.Conn) io.ReadWriteCloser { return readWriteCloser{c} },
+			client: func(c net.Conn) io.ReadWriteCloser { return readWriteCloser{c} },
+		},
+	} {
+		serverSide, clientSide := net.Pipe()
+
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+			wsServer.ServeConn(tc.server(serverSide))
+		}()
+
+		client := NewClientConn(tc.client(clientSide))
+
+		client.WriteText([]byte("over the pipe"))
+
+		if _, data, err := client.Read(); err != nil || string(data) != "over the pipe" {
+			t.Errorf("%s: unexpected message %q %v", tc.name, data, err)
+		}
+
+		if err := client.Close(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: ServeConn did not return", tc.name)
+		}
+	}
+}
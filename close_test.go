@@ -0,0 +1,352 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_ServerCloseWithReason(t *testing.T) {
+	wsServer := &Server{}
+
+	closeErrs := make(chan error, 1)
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.CloseWithReason(WebsocketStatusCodeApplicationMin+1, "bye")
+
+		_, err := c.Write([]byte("after close"))
+		closeErrs <- err
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Write([]byte("close me"))
+
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err = client.Read()
+
+	closeErr, ok := err.(*CloseError)
+
+	if !ok {
+		t.Fatalf("expected close error, got %v", err)
+	}
+
+	if closeErr.Code != 4001 || closeErr.Text != "bye" {
+		t.Errorf("unexpected close error %v", closeErr)
+	}
+
+	if _, _, err := client.Read(); err != closeErr {
+		t.Errorf("read after close should return the close error, got %v", err)
+	}
+
+	if err := <-closeErrs; err != ErrCloseSent {
+		t.Errorf("expected %v, got %v", ErrCloseSent, err)
+	}
+}
+
+func Test_ClientCloseHandshake(t *testing.T) {
+	wsServer := &Server{}
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.CloseWithReason(WebsocketStatusCodeAbnormalClosure, ""); err != ErrCloseCodeNotAllowed {
+		t.Errorf("expected %v, got %v", ErrCloseCodeNotAllowed, err)
+	}
+
+	if err := client.CloseWithReason(WebsocketStatusCodeGoingAway, "going away"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server echo the status code back
+	_, _, err = client.Read()
+
+	var closeErr *CloseError
+
+	if !errors.As(err, &closeErr) || closeErr.Code != WebsocketStatusCodeGoingAway {
+		t.Errorf("expected going away close error, got %v", err)
+	}
+
+	if err := client.Write([]byte("after close")); err != closeErr {
+		t.Errorf("write after close should return the close error, got %v", err)
+	}
+}
+
+func Test_ServerCloseTimeout(t *testing.T) {
+	wsServer := &Server{
+		CloseTimeout: 100 * time.Millisecond,
+	}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.Close()
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Write([]byte("close me"))
+
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// read the close frame without answering it
+	frame := newFrame()
+	reader := frameReader{readLimit: -1}
+
+	if err := reader.read(client.rwBuffer, frame); err != nil || !frame.IsClose() {
+		t.Fatalf("expected close frame, got %v %v", frame, err)
+	}
+
+	if err := reader.read(client.rwBuffer, frame); err != io.EOF {
+		t.Errorf("expected the server force close the connection, got %v", err)
+	}
+}
+
+func Test_ServerRejectInvalidCloseCode(t *testing.T) {
+	wsServer := &Server{}
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte{0x03, 0xed} // 1005 must not be sent on the wire
+	writeTestFrame(t, client, codeClose, true, payload)
+
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err = client.Read()
+
+	closeErr, ok := err.(*CloseError)
+
+	if !ok || closeErr.Code != WebsocketStatusCodeProtocolError {
+		t.Errorf("expected protocol error close, got %v", err)
+	}
+}
+
+func Test_ServerCloseWriteQueueFull(t *testing.T) {
+	wsServer := &Server{
+		WriteQueueSize: 2,
+		CloseTimeout:   100 * time.Millisecond,
+	}
+
+	opened := make(chan *Conn, 1)
+	closed := make(chan struct{})
+
+	wsServer.OnOpen(func(c *Conn) {
+		opened <- c
+	})
+
+	wsServer.OnClose(func(c *Conn, code WebsocketStatusCode, reason string) {
+		close(closed)
+	})
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	go wsServer.ServeConn(serverSide)
+
+	conn := <-opened
+
+	// the client never reads, the writes fill the queue
+	go func() {
+		for conn.WriteText([]byte("hello")) == nil {
+		}
+	}()
+
+	for len(conn.WriteChan) < cap(conn.WriteChan) {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- conn.Close()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected close error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on the full write queue")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the close timeout did not tear the connection down")
+	}
+}
+
+func Test_ClientReadAfterFailure(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+
+	client := NewClientConn(clientSide)
+
+	go func() {
+		// the text message of the server is not valid UTF-8
+		frame := newFrame()
+		frame.SetFin()
+		frame.SetFrameType(codeText)
+		frame.SetPayload([]byte{0xff})
+		frame.SetPayloadSize(1)
+		frame.WriteTo(serverSide)
+
+		// take the close frame of the client
+		io.Copy(io.Discard, serverSide)
+	}()
+
+	if _, _, err := client.Read(); err == nil {
+		t.Fatal("expected the invalid message to fail the connection")
+	}
+
+	for i := 0; i < 2; i++ {
+		_, _, err := client.Read()
+
+		closeErr, ok := err.(*CloseError)
+
+		if !ok || closeErr.Code != WebsocketStatusCodeInvalidFramePayloadData {
+			t.Errorf("expected close error %v, got %v", WebsocketStatusCodeInvalidFramePayloadData, err)
+		}
+	}
+
+	if _, _, err := client.NextReader(); !errors.As(err, new(*CloseError)) {
+		t.Errorf("expected close error, got %v", err)
+	}
+}
+
+func Test_ClientCloseAfterServerClose(t *testing.T) {
+	wsServer := &Server{}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.CloseWithReason(WebsocketStatusCodeGoingAway, "bye")
+	})
+
+	url := newTestServer(t, wsServer)
+
+	client, err := NewClient(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Write([]byte("close me"))
+
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, _, err := client.Read(); !errors.As(err, new(*CloseError)) {
+		t.Fatalf("expected close error, got %v", err)
+	}
+
+	// the close handshake is already complete
+	if err := client.Close(); err != nil {
+		t.Errorf("expected no error after the server closed first, got %v", err)
+	}
+
+	started, err := NewClient(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+
+	started.OnClose(func(c *Conn, code WebsocketStatusCode, reason string) {
+		close(closed)
+	})
+
+	started.Start()
+	started.Write([]byte("close me"))
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server did not close the started client")
+	}
+
+	if err := started.Close(); err != nil {
+		t.Errorf("expected no error after the server closed first, got %v", err)
+	}
+}
+
+func Test_ClientCloseFrameOnlyOnce(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+
+	client := NewClientConn(clientSide)
+
+	closeFrames := make(chan int, 1)
+
+	go func() {
+		br := bufio.NewReader(serverSide)
+		reader := frameReader{isServer: true, readLimit: -1}
+		frame := newFrame()
+
+		count := 0
+
+		if err := reader.read(br, frame); err != nil || !frame.IsClose() {
+			closeFrames <- -1
+			return
+		}
+
+		count++
+
+		// the masked frame from the server breaks the protocol while the client waits the close frame
+		frame = newFrame()
+		frame.SetFin()
+		frame.SetFrameType(codeText)
+		frame.SetPayload([]byte("masked"))
+		frame.SetPayloadSize(6)
+		frame.SetMask()
+
+		// the frame is written at once, the client stops reading at its header
+		buffer := bytes.Buffer{}
+		frame.WriteTo(&buffer)
+		serverSide.Write(buffer.Bytes())
+
+		for {
+			frame := newFrame()
+
+			if err := reader.read(br, frame); err != nil {
+				break
+			}
+
+			if frame.IsClose() {
+				count++
+			}
+		}
+
+		closeFrames <- count
+	}()
+
+	if err := client.Close(); err == nil {
+		t.Error("expected the protocol error of the server")
+	}
+
+	select {
+	case count := <-closeFrames:
+		if count != 1 {
+			t.Errorf("expected 1 close frame, got %d", count)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client did not close the connection")
+	}
+}
@@ -0,0 +1,434 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	permessageDeflate = "permessage-deflate"
+
+	serverNoContextTakeover = "server_no_context_takeover"
+	clientNoContextTakeover = "client_no_context_takeover"
+	serverMaxWindowBits     = "server_max_window_bits"
+	clientMaxWindowBits     = "client_max_window_bits"
+
+	// maxWindowSize is the LZ77 window of compress/flate, it is 2^15
+	maxWindowSize = 1 << 15
+
+	defaultCompressionLevel = flate.BestSpeed
+)
+
+var (
+	// deflateTail is the end of the sync flush, it is stripped from the compressed message
+	deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+	// inflateTail put the stripped tail back and end the stream by an empty final block
+	inflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+	errInvalidCompressedData = errors.New("compressed message is not valid deflate data")
+
+	// ErrInvalidExtension shows up when the server accepts an extension the client did not offer
+	ErrInvalidExtension = errors.New("websocket: server responded with an invalid extension")
+)
+
+// compressionParams is the negotiated permessage-deflate parameters of RFC 7692
+type compressionParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+}
+
+// compressionOptions is the compression settings of a connection after negotiation
+type compressionOptions struct {
+	params compressionParams
+
+	// level is the flate level and threshold is the min payload size compressed by default
+	level     int
+	threshold int
+
+	// compressor and decompressor keep the history of the messages exchanged before
+	// the conn takes the connection over, they are created when nil
+	compressor   *compressor
+	decompressor *decompressor
+}
+
+// extension is one extension of the Sec-WebSocket-Extensions header with its parameters
+type extension struct {
+	name   string
+	params [][2]string
+}
+
+// parseExtensions parse the Sec-WebSocket-Extensions header, the extensions are
+// separated by comma and the parameters by semicolon
+func parseExtensions(header string) []extension {
+	var extensions []extension
+
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+
+		ext := extension{name: strings.TrimSpace(parts[0])}
+
+		if ext.name == "" {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+
+			ext.params = append(ext.params, [2]string{strings.TrimSpace(name), value})
+		}
+
+		extensions = append(extensions, ext)
+	}
+
+	return extensions
+}
+
+// negotiateCompression select the first permessage-deflate offer of the client the
+// server can accept, it return the parameters and the value of the response header
+func negotiateCompression(header string) (compressionParams, string, bool) {
+offers:
+	for _, offer := range parseExtensions(header) {
+		if offer.name != permessageDeflate {
+			continue
+		}
+
+		params := compressionParams{}
+		seen := map[string]bool{}
+
+		for _, param := range offer.params {
+			name, value := param[0], param[1]
+
+			if seen[name] {
+				continue offers
+			}
+
+			seen[name] = true
+
+			switch name {
+			case serverNoContextTakeover:
+				if value != "" {
+					continue offers
+				}
+
+				params.serverNoContextTakeover = true
+			case clientNoContextTakeover:
+				if value != "" {
+					continue offers
+				}
+
+				params.clientNoContextTakeover = true
+			case serverMaxWindowBits:
+				// compress/flate always use the full window, a smaller one cannot be honored
+				if bits, ok := parseWindowBits(value); !ok || bits != 15 {
+					continue offers
+				}
+			case clientMaxWindowBits:
+				// the client only tells it supports the parameter, any window can be inflated
+				if value != "" {
+					if _, ok := parseWindowBits(value); !ok {
+						continue offers
+					}
+				}
+			default:
+				continue offers
+			}
+		}
+
+		response := permessageDeflate
+
+		if params.serverNoContextTakeover {
+			response += "; " + serverNoContextTakeover
+		}
+
+		if params.clientNoContextTakeover {
+			response += "; " + clientNoContextTakeover
+		}
+
+		return params, response, true
+	}
+
+	return compressionParams{}, "", false
+}
+
+// parseCompressionResponse parse the extensions accepted by the server, the client
+// only offers permessage-deflate without parameters
+func parseCompressionResponse(header string) (*compressionParams, error) {
+	extensions := parseExtensions(header)
+
+	if len(extensions) == 0 {
+		return nil, nil
+	}
+
+	if len(extensions) > 1 || extensions[0].name != permessageDeflate {
+		return nil, ErrInvalidExtension
+	}
+
+	params := &compressionParams{}
+
+	for _, param := range extensions[0].params {
+		name, value := param[0], param[1]
+
+		switch name {
+		case serverNoContextTakeover:
+			params.serverNoContextTakeover = true
+		case clientNoContextTakeover:
+			params.clientNoContextTakeover = true
+		case serverMaxWindowBits:
+			// a smaller window of the server is fine for the inflate
+			if _, ok := parseWindowBits(value); !ok {
+				return nil, ErrInvalidExtension
+			}
+		default:
+			// client_max_window_bits was not offered, it cannot be in the response
+			return nil, ErrInvalidExtension
+		}
+	}
+
+	return params, nil
+}
+
+// compressionLevel return the flate level of the setting, zero means the default level
+func compressionLevel(level int) int {
+	if level == 0 {
+		return defaultCompressionLevel
+	}
+
+	return level
+}
+
+func parseWindowBits(value string) (int, bool) {
+	bits, err := strconv.Atoi(value)
+
+	return bits, err == nil && bits >= 8 && bits <= 15
+}
+
+// compressor compress the messages of a connection, the flate writer is kept across
+// the messages unless noContextTakeover, so the later messages refer to the earlier ones
+type compressor struct {
+	level             int
+	noContextTakeover bool
+
+	writer *flate.Writer
+
+	// dst is where the flate writer writes the message being compressed
+	dst    switchWriter
+	buffer bytes.Buffer
+}
+
+// compress return the compressed payload without the sync flush tail, the
+// payload is only valid until the next message is compressed
+func (c *compressor) compress(data []byte) ([]byte, error) {
+	c.buffer.Reset()
+
+	if err := c.reset(&c.buffer); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.writer.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(c.buffer.Bytes(), deflateTail), nil
+}
+
+// newWriter return a writer compressing a message into w, w receives the
+// compressed data without the sync flush tail when it is closed
+func (c *compressor) newWriter(w io.Writer) (io.WriteCloser, error) {
+	tail := &trimTailWriter{w: w}
+
+	if err := c.reset(tail); err != nil {
+		return nil, err
+	}
+
+	return &compressWriter{flate: c.writer, tail: tail}, nil
+}
+
+// reset point the flate writer to w for the next message, the history of the
+// previous messages is dropped only without context takeover
+func (c *compressor) reset(w io.Writer) error {
+	c.dst.w = w
+
+	if c.writer == nil {
+		writer, err := flate.NewWriter(&c.dst, c.level)
+
+		if err != nil {
+			return err
+		}
+
+		c.writer = writer
+	} else if c.noContextTakeover {
+		c.writer.Reset(&c.dst)
+	}
+
+	return nil
+}
+
+// switchWriter let the flate writer keep its history while the destination changes
+type switchWriter struct {
+	w io.Writer
+}
+
+func (w *switchWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// decompressor inflate the messages of a connection, the last 32 KB of the output
+// is the dictionary of the next message unless noContextTakeover
+type decompressor struct {
+	noContextTakeover bool
+
+	reader io.ReadCloser
+	dict   []byte
+}
+
+// decompress inflate the whole message, the output is limited by the read limit
+func (d *decompressor) decompress(data []byte, readLimit int64) ([]byte, error) {
+	r := d.newReader(bytes.NewReader(data), readLimit)
+
+	return io.ReadAll(r)
+}
+
+// newReader return a reader inflating the message read from r
+func (d *decompressor) newReader(r io.Reader, readLimit int64) io.Reader {
+	r = io.MultiReader(r, bytes.NewReader(inflateTail))
+
+	if d.reader == nil {
+		d.reader = flate.NewReaderDict(r, d.dict)
+	} else {
+		d.reader.(flate.Resetter).Reset(r, d.dict)
+	}
+
+	return &decompressReader{d: d, readLimit: readLimit}
+}
+
+// keep the output as the dictionary of the next message
+func (d *decompressor) keep(p []byte) {
+	if d.noContextTakeover {
+		return
+	}
+
+	if len(p) >= maxWindowSize {
+		d.dict = append(d.dict[:0], p[len(p)-maxWindowSize:]...)
+		return
+	}
+
+	if len(d.dict)+len(p) > maxWindowSize {
+		d.dict = append(d.dict[:0], d.dict[len(d.dict)+len(p)-maxWindowSize:]...)
+	}
+
+	d.dict = append(d.dict, p...)
+}
+
+// decompressReader read the inflated message and check the read limit on the output
+type decompressReader struct {
+	d         *decompressor
+	readLimit int64
+	n         int64
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	n, err := r.d.reader.Read(p)
+
+	r.d.keep(p[:n])
+	r.n += int64(n)
+
+	if r.readLimit >= 0 && r.n > r.readLimit {
+		return n, ErrMessageTooBig
+	}
+
+	if err != nil && err != io.EOF {
+		// the errors of the message reader are kept, the flate errors mean the data is corrupted
+		var flateErr flate.CorruptInputError
+
+		if errors.As(err, &flateErr) || err == io.ErrUnexpectedEOF {
+			err = errInvalidCompressedData
+		}
+	}
+
+	return n, err
+}
+
+// validateReader validate the UTF-8 of the text read from r
+type validateReader struct {
+	r    io.Reader
+	utf8 utf8Validator
+}
+
+func (r *validateReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+
+	if !r.utf8.write(p[:n]) || (err == io.EOF && !r.utf8.done()) {
+		return 0, errInvalidUTF8
+	}
+
+	return n, err
+}
+
+// compressWriter write the message through the flate writer, Close flush it
+// and drop the sync flush tail
+type compressWriter struct {
+	flate *flate.Writer
+	tail  *trimTailWriter
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	return w.flate.Write(p)
+}
+
+func (w *compressWriter) Close() error {
+	if err := w.flate.Flush(); err != nil {
+		return err
+	}
+
+	return w.tail.close()
+}
+
+// trimTailWriter hold the last 4 bytes back, so the sync flush tail is never written
+type trimTailWriter struct {
+	w    io.Writer
+	tail []byte
+}
+
+func (w *trimTailWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	data := append(w.tail, p...)
+
+	if len(data) <= len(deflateTail) {
+		w.tail = data
+		return n, nil
+	}
+
+	split := len(data) - len(deflateTail)
+
+	if _, err := w.w.Write(data[:split]); err != nil {
+		return 0, err
+	}
+
+	w.tail = append([]byte(nil), data[split:]...)
+
+	return n, nil
+}
+
+func (w *trimTailWriter) close() error {
+	tail := w.tail
+	w.tail = nil
+
+	if bytes.Equal(tail, deflateTail) {
+		return nil
+	}
+
+	_, err := w.w.Write(tail)
+
+	return err
+}
@@ -0,0 +1,285 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func Test_NegotiateCompression(t *testing.T) {
+	testCases := []struct {
+		name     string
+		header   string
+		params   compressionParams
+		response string
+		ok       bool
+	}{
+		{"no offer", "", compressionParams{}, "", false},
+		{"other extension", "x-webkit-deflate-frame", compressionParams{}, "", false},
+		{"plain offer", "permessage-deflate", compressionParams{}, "permessage-deflate", true},
+		{"browser offer", "permessage-deflate; client_max_window_bits", compressionParams{}, "permessage-deflate", true},
+		{
+			"no context takeover",
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			compressionParams{serverNoContextTakeover: true, clientNoContextTakeover: true},
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			true,
+		},
+		{"full server window", "permessage-deflate; server_max_window_bits=15", compressionParams{}, "permessage-deflate", true},
+		{"quoted window bits", `permessage-deflate; client_max_window_bits="10"`, compressionParams{}, "permessage-deflate", true},
+		{"small server window", "permessage-deflate; server_max_window_bits=10", compressionParams{}, "", false},
+		{"fallback offer", "permessage-deflate; server_max_window_bits=10, permessage-deflate", compressionParams{}, "permessage-deflate", true},
+		{"invalid window bits", "permessage-deflate; client_max_window_bits=16", compressionParams{}, "", false},
+		{"duplicate param", "permessage-deflate; server_no_context_takeover; server_no_context_takeover", compressionParams{}, "", false},
+		{"unknown param", "permessage-deflate; foo", compressionParams{}, "", false},
+	}
+
+	for _, testCase := range testCases {
+		params, response, ok := negotiateCompression(testCase.header)
+
+		if params != testCase.params || response != testCase.response || ok != testCase.ok {
+			t.Errorf("%s: unexpected %v %q %v", testCase.name, params, response, ok)
+		}
+	}
+}
+
+func Test_ParseCompressionResponse(t *testing.T) {
+	if params, err := parseCompressionResponse(""); params != nil || err != nil {
+		t.Errorf("expected no compression, got %v %v", params, err)
+	}
+
+	params, err := parseCompressionResponse("permessage-deflate; client_no_context_takeover; server_max_window_bits=12")
+
+	if err != nil || !params.clientNoContextTakeover || params.serverNoContextTakeover {
+		t.Errorf("unexpected params %v %v", params, err)
+	}
+
+	for _, header := range []string{
+		"x-webkit-deflate-frame",
+		"permessage-deflate, permessage-deflate",
+		"permessage-deflate; client_max_window_bits=10",
+		"permessage-deflate; server_max_window_bits=7",
+	} {
+		if _, err := parseCompressionResponse(header); err != ErrInvalidExtension {
+			t.Errorf("%s: expected %v, got %v", header, ErrInvalidExtension, err)
+		}
+	}
+}
+
+func Test_CompressContextTakeover(t *testing.T) {
+	message := bytes.Repeat([]byte("context takeover "), 100)
+
+	for _, noContextTakeover := range []bool{false, true} {
+		c := &compressor{level: defaultCompressionLevel, noContextTakeover: noContextTakeover}
+		d := &decompressor{noContextTakeover: noContextTakeover}
+
+		var sizes []int
+
+		for i := 0; i < 3; i++ {
+			payload, err := c.compress(message)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sizes = append(sizes, len(payload))
+
+			data, err := d.decompress(payload, -1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(data, message) {
+				t.Fatalf("message %d is not the same after decompress", i)
+			}
+		}
+
+		// the later message refers to the earlier one only with context takeover
+		if smaller := sizes[1] < sizes[0]; smaller == noContextTakeover {
+			t.Errorf("no context takeover %v: unexpected compressed sizes %v", noContextTakeover, sizes)
+		}
+	}
+}
+
+func Test_CompressWriter(t *testing.T) {
+	message := bytes.Repeat([]byte("stream "), 10000)
+
+	c := &compressor{level: defaultCompressionLevel}
+	d := &decompressor{}
+
+	for i := 0; i < 2; i++ {
+		buffer := bytes.Buffer{}
+
+		w, err := c.newWriter(&buffer)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w.Write(message[:1000])
+		w.Write(message[1000:])
+
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.HasSuffix(buffer.Bytes(), deflateTail) {
+			t.Error("the sync flush tail should be stripped")
+		}
+
+		data, err := io.ReadAll(d.newReader(&buffer, -1))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, message) {
+			t.Fatalf("message %d is not the same after decompress", i)
+		}
+	}
+}
+
+func Test_CompressionEcho(t *testing.T) {
+	wsServer := &Server{
+		EnableCompression:    true,
+		CompressionThreshold: 64,
+	}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		if isBinary {
+			c.WriteBinary(data)
+		} else {
+			c.WriteText(data)
+		}
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.compressor == nil {
+		t.Fatal("compression should be negotiated")
+	}
+
+	client.c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	messages := [][]byte{
+		[]byte("small"),
+		bytes.Repeat([]byte("compressed text "), 1000),
+		bytes.Repeat([]byte("again "), 1000),
+	}
+
+	for _, message := range messages {
+		if err := client.WriteText(message); err != nil {
+			t.Fatal(err)
+		}
+
+		messageType, data, err := client.Read()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if messageType != TextMessage || !bytes.Equal(data, message) {
+			t.Errorf("unexpected message %v %d bytes", messageType, len(data))
+		}
+	}
+
+	// a small message can still be compressed and a big one sent as it is
+	for _, compress := range []bool{true, false} {
+		if err := client.WriteMessageWithCompression(BinaryMessage, messages[2], compress); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, data, err := client.Read(); err != nil || !bytes.Equal(data, messages[2]) {
+			t.Errorf("compress %v: unexpected message %d bytes %v", compress, len(data), err)
+		}
+	}
+
+	w, err := client.NextWriter(TextMessage)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write(messages[1])
+	w.Close()
+
+	_, r, err := client.NextReader()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, messages[1]) {
+		t.Errorf("unexpected streamed message %d bytes %v", len(data), err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_CompressionDisabled(t *testing.T) {
+	wsServer := &Server{}
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if client.compressor != nil {
+		t.Error("compression should not be negotiated")
+	}
+}
+
+func Test_CompressionFailures(t *testing.T) {
+	testCases := []struct {
+		name    string
+		payload []byte
+		code    WebsocketStatusCode
+	}{
+		{"invalid deflate data", []byte{0xff, 0xff, 0xff}, WebsocketStatusCodeInvalidFramePayloadData},
+		{"inflated over the read limit", nil, WebsocketStatusCodeMessageTooBig},
+		{"inflated invalid UTF-8", nil, WebsocketStatusCodeInvalidFramePayloadData},
+	}
+
+	c := &compressor{level: defaultCompressionLevel, noContextTakeover: true}
+
+	testCases[1].payload, _ = c.compress(make([]byte, 1<<20))
+	testCases[1].payload = append([]byte(nil), testCases[1].payload...)
+	testCases[2].payload, _ = c.compress([]byte{0xff, 0xfe})
+
+	for _, testCase := range testCases {
+		wsServer := &Server{
+			EnableCompression: true,
+			ReadLimit:         1024,
+		}
+
+		client, err := NewClient(newTestServer(t, wsServer))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client.c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// the payload is small on the wire, only the inflated message breaks the rules
+		if err := client.sendFrame(TextMessage, testCase.payload, true, true); err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = client.Read()
+
+		if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != testCase.code {
+			t.Errorf("%s: expected close %d, got %v", testCase.name, testCase.code, err)
+		}
+	}
+}
@@ -3,20 +3,140 @@ package websocket
 import (
 	"bufio"
 	"context"
-	"fmt"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	readChanSize  = 128
-	writeChanSize = 128
+	defaultReadQueueSize  = 128
+	defaultWriteQueueSize = 128
+
+	// defaultCloseTimeout is how long to wait the close frame from the peer before force close
+	defaultCloseTimeout = 5 * time.Second
+
+	maxCloseReasonSize = 123
+
+	// defaultReadLimit is the max size of a message from the peer when it is not set
+	defaultReadLimit = 32 << 20
 )
 
+// connConfig is the settings of the conn which must be set before the loops start
+type connConfig struct {
+	isServer     bool
+	validateUTF8 bool
+	closeTimeout time.Duration
+	readLimit    int64
+
+	pingHandler PingHandler
+	pongHandler PongHandler
+
+	// pingInterval send a ping every interval when it is set, the conn is closed
+	// when the pong does not arrive in pongTimeout
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// compression is set when permessage-deflate is negotiated
+	compression *compressionOptions
+
+	// bufferReader and bufferWriter keep the data buffered during the handshake,
+	// they are created on the connection by the buffer sizes when they are nil
+	bufferReader *bufio.Reader
+	bufferWriter *bufio.Writer
+
+	readBufferSize  int
+	writeBufferSize int
+
+	// readQueueSize and writeQueueSize are the sizes of ReadChan and WriteChan
+	readQueueSize  int
+	writeQueueSize int
+
+	// subprotocol is the Sec-WebSocket-Protocol selected by the server
+	subprotocol string
+
+	// request is the opening handshake of the client kept by the server
+	request *handshakeRequest
+
+	locals *Locals
+}
+
+// handshakeRequest is the data of the opening handshake kept on the conn after the hijack
+type handshakeRequest struct {
+	header   http.Header
+	path     string
+	query    url.Values
+	cookies  []*http.Cookie
+	tlsState *tls.ConnectionState
+}
+
+// connID is the last ID given to a conn
+var connID atomic.Uint64
+
 type Conn struct {
 	c net.Conn
 
-	isClose bool
+	// id is unique among the conns of the process
+	id uint64
+
+	isClose atomic.Bool
+
+	// closeSent is set when the close frame is queued, no more frame can be written after it
+	closeSent atomic.Bool
+
+	// isServer tells the conn is the server side, the frames from the peer must be masked.
+	// The conn of the client side masks its frames instead
+	isServer bool
+
+	subprotocol string
+
+	request *handshakeRequest
+	locals  *Locals
+
+	reader frameReader
+
+	closeTimeout time.Duration
+
+	pingHandler PingHandler
+	pongHandler PongHandler
+
+	// idleTimeout and writeTimeout are applied to every frame on top of the deadlines
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// readDeadline and writeDeadline are the unix nano time set by the deadline setters
+	readDeadline  atomic.Int64
+	writeDeadline atomic.Int64
+
+	// lastPong is the unix nano time the last pong arrived, it is updated by the readLoop
+	lastPong atomic.Int64
+
+	// messageMutex is held while a data message is queued, the frames of a message
+	// from NextWriter must not interleave with the frames of another message
+	messageMutex sync.Mutex
+
+	// nextReader is the message reader returned by the last NextReader
+	nextReader nextReader
+
+	// compressor compress the data messages when permessage-deflate is negotiated, the
+	// message smaller than compressionThreshold is sent uncompressed by WriteMessage.
+	// It is guarded by messageMutex
+	compressor           *compressor
+	compressionThreshold int
+
+	mutex      sync.Mutex
+	err        error
+	closeErr   *CloseError
+	closeTimer *time.Timer
 
 	waitGroup sync.WaitGroup
 
@@ -29,48 +149,204 @@ type Conn struct {
 	ReadChan  chan *Frame
 	WriteChan chan *Frame
 
+	// writeDone is closed when the writeLoop flushed the pending frames and exit
+	writeDone chan struct{}
+
+	// message reassemble the fragmented data frames from ReadChan
+	message messageBuffer
+
+	// broadcasts queue the messages of Hub.Broadcast, they are written by broadcastLoop
+	broadcasts chan bufferedMessage
+
 	wg sync.WaitGroup
 }
 
+// ErrDeadlineNotSupported shows up when setting the deadline of the connection made of an io.ReadWriteCloser
+var ErrDeadlineNotSupported = errors.New("websocket: deadline is not supported by the io.ReadWriteCloser")
+
+// rwcConn let the io.ReadWriteCloser be the connection, it has no address and no deadline
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+type rwcAddr struct{}
+
+func (rwcAddr) Network() string { return "rwc" }
+func (rwcAddr) String() string  { return "rwc" }
+
+func (c *rwcConn) LocalAddr() net.Addr                { return rwcAddr{} }
+func (c *rwcConn) RemoteAddr() net.Addr               { return rwcAddr{} }
+func (c *rwcConn) SetDeadline(t time.Time) error      { return ErrDeadlineNotSupported }
+func (c *rwcConn) SetReadDeadline(t time.Time) error  { return ErrDeadlineNotSupported }
+func (c *rwcConn) SetWriteDeadline(t time.Time) error { return ErrDeadlineNotSupported }
+
+// toNetConn return the net.Conn as it is and wrap the other io.ReadWriteCloser
+func toNetConn(c io.ReadWriteCloser) net.Conn {
+	if conn, ok := c.(net.Conn); ok {
+		return conn
+	}
+
+	return &rwcConn{ReadWriteCloser: c}
+}
+
 func NewConn(ctx context.Context, conn net.Conn, cancel context.CancelFunc) *Conn {
+	return newConn(ctx, conn, cancel, connConfig{
+		isServer:     true,
+		validateUTF8: true,
+		closeTimeout: defaultCloseTimeout,
+		readLimit:    defaultReadLimit,
+	})
+}
+
+func newConn(ctx context.Context, conn net.Conn, cancel context.CancelFunc, config connConfig) *Conn {
 
 	c := &Conn{
 		c:            conn,
+		id:           connID.Add(1),
+		isServer:     config.isServer,
+		subprotocol:  config.subprotocol,
+		request:      config.request,
+		locals:       config.locals,
+		closeTimeout: config.closeTimeout,
+		pingHandler:  config.pingHandler,
+		pongHandler:  config.pongHandler,
+		idleTimeout:  config.idleTimeout,
+		writeTimeout: config.writeTimeout,
 		ctx:          ctx,
 		cancel:       cancel,
-		bufferReader: bufio.NewReader(conn),
-		bufferWriter: bufio.NewWriter(conn),
-		ReadChan:     make(chan *Frame, readChanSize),
-		WriteChan:    make(chan *Frame, writeChanSize),
+		bufferReader: config.bufferReader,
+		bufferWriter: config.bufferWriter,
+		ReadChan:     make(chan *Frame, queueSize(config.readQueueSize, defaultReadQueueSize)),
+		WriteChan:    make(chan *Frame, queueSize(config.writeQueueSize, defaultWriteQueueSize)),
+		writeDone:    make(chan struct{}),
+	}
+
+	if c.request == nil {
+		c.request = &handshakeRequest{}
+	}
+
+	if c.locals == nil {
+		c.locals = &Locals{}
+	}
+
+	if c.bufferReader == nil {
+		c.bufferReader = newBufioReader(conn, config.readBufferSize)
+	}
+
+	if c.bufferWriter == nil {
+		c.bufferWriter = newBufioWriter(conn, config.writeBufferSize)
+	}
+
+	c.message.validateUTF8 = config.validateUTF8
+	c.message.readLimit = config.readLimit
+
+	// the big frame is split by the buffer size to bound the memory of ReadChan
+	c.reader = frameReader{
+		isServer:  config.isServer,
+		readLimit: config.readLimit,
+		chunkSize: int64(c.bufferReader.Size()),
+	}
+
+	if config.compression != nil {
+		c.enableCompression(config.compression)
 	}
 
 	c.waitGroup.Add(2)
 	go c.readLoop()
 	go c.writeLoop()
 
+	if config.pingInterval > 0 {
+		c.waitGroup.Add(1)
+		go c.keepalive(config.pingInterval, config.pongTimeout)
+	}
+
 	return c
 }
 
+// queueSize return the size of the queue or the default size when it is not set
+func queueSize(size, defaultSize int) int {
+	if size > 0 {
+		return size
+	}
+
+	return defaultSize
+}
+
+// enableCompression set up the compressor and the decompressor by the negotiated parameters,
+// the server_* parameters are about the messages of the server and the client_* the client
+func (c *Conn) enableCompression(options *compressionOptions) {
+	writeNoContextTakeover := options.params.serverNoContextTakeover
+	readNoContextTakeover := options.params.clientNoContextTakeover
+
+	if !c.isServer {
+		writeNoContextTakeover, readNoContextTakeover = readNoContextTakeover, writeNoContextTakeover
+	}
+
+	c.reader.compression = true
+	c.message.decompressor = options.decompressor
+	c.compressor = options.compressor
+	c.compressionThreshold = options.threshold
+
+	if c.message.decompressor == nil {
+		c.message.decompressor = &decompressor{noContextTakeover: readNoContextTakeover}
+	}
+
+	if c.compressor == nil {
+		c.compressor = &compressor{level: compressionLevel(options.level), noContextTakeover: writeNoContextTakeover}
+	}
+}
+
 func (c *Conn) readLoop() {
 	for {
 
 		newFrame := AcquireFrame()
 
-		_, err := newFrame.ReadFrom(c.bufferReader)
+		// the idle timeout starts again for every frame
+		if c.idleTimeout > 0 {
+			c.c.SetReadDeadline(deadline(c.readDeadline.Load(), c.idleTimeout))
+		}
+
+		err := c.reader.read(c.bufferReader, newFrame)
 
 		if err != nil {
-			c.isClose = true
+			// the peer broke the protocol, tell it why before tear down the connection
+			if isFailure(err) {
+				c.fail(err)
+			} else {
+				// the peer may still be alive after the read timeout, tell it before tear down
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					c.writeClose(WebsocketStatusCodeGoingAway, "read timeout")
+				}
+
+				// the connection is gone without close frame
+				c.setCloseError(&CloseError{Code: WebsocketStatusCodeAbnormalClosure})
+				c.setIOError(err)
+			}
+
+			c.isClose.Store(true)
 			c.cancel()
 
 			ReleaseFrame(newFrame)
 			break
 		}
 
-		c.ReadChan <- newFrame
+		if newFrame.IsPong() {
+			c.lastPong.Store(time.Now().UnixNano())
+		}
+
+		// the frame belongs to the consumer once it is sent
+		isCloseFrame := newFrame.IsClose()
+
+		if !c.queueFrame(newFrame) {
+			// the conn is shutting down, nobody drains ReadChan any more
+			ReleaseFrame(newFrame)
+			c.isClose.Store(true)
+			break
+		}
 
 		// receive close frame just end readLoop routine
-		if newFrame.IsClose() || c.isClose {
-			c.isClose = true
+		if isCloseFrame || c.isClose.Load() {
+			c.isClose.Store(true)
 			break
 		}
 
@@ -79,23 +355,189 @@ func (c *Conn) readLoop() {
 	c.waitGroup.Done()
 }
 
+// queueFrame send the frame from the peer to ReadChan, it report false when the
+// context is cancelled while ReadChan is full
+func (c *Conn) queueFrame(frame *Frame) bool {
+	select {
+	case c.ReadChan <- frame:
+		return true
+	default:
+	}
+
+	select {
+	case c.ReadChan <- frame:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// messageLoop deliver the messages of the connection to the handler until the connection ends
+func (c *Conn) messageLoop(messageHandler MessageHandler) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case frame := <-c.ReadChan:
+			isCloseFrame := frame.IsClose()
+
+			if frame.IsControl() {
+				c.handleControl(frame)
+			} else {
+				c.dataFrameHandler(messageHandler, frame)
+			}
+
+			ReleaseFrame(frame)
+
+			// the readLoop failing cancels the context, the close frame in ReadChan is still handled
+			if isCloseFrame {
+				return
+			}
+		}
+	}
+}
+
+func (c *Conn) dataFrameHandler(messageHandler MessageHandler, frame *Frame) {
+	// the failed connection processes no more data, only the close handshake goes on
+	if c.Err() != nil {
+		return
+	}
+
+	complete, err := c.message.push(frame)
+
+	if err != nil {
+		c.message.reset()
+		c.fail(err)
+		return
+	}
+
+	// wait the rest of the fragmented message
+	if !complete {
+		return
+	}
+
+	frameType, payload := c.message.take()
+
+	if messageHandler != nil {
+		isBinary := frameType == codeBinary
+
+		messageHandler(c, isBinary, payload)
+	}
+}
+
+// shutdown let the writeLoop flush the pending frames like the close frame, close the
+// connection and wait the loops end. The data frames left in ReadChan go to onDataFrame
+// when it is set
+func (c *Conn) shutdown(onDataFrame func(frame *Frame)) {
+	c.cancel()
+	<-c.writeDone
+	c.stopCloseTimer()
+
+	// clean all the channel data prevent goroutine leak
+	c.c.Close()
+
+	for len(c.ReadChan) > 0 {
+		fr, ok := <-c.ReadChan
+
+		if !ok {
+			break
+		}
+
+		if onDataFrame != nil && !fr.IsControl() {
+			onDataFrame(fr)
+		}
+
+		ReleaseFrame(fr)
+	}
+
+	c.waitGroup.Wait()
+}
+
+// keepalive send a ping every interval, the conn is closed with WebsocketStatusCodeGoingAway
+// when the pong of the ping does not arrive in the timeout
+func (c *Conn) keepalive(interval time.Duration, timeout time.Duration) {
+	defer c.waitGroup.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pongTimer := time.NewTimer(timeout)
+	pongTimer.Stop()
+	defer pongTimer.Stop()
+
+	var pingTime int64
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			// the pong timer keeps running until the pong of the last ping arrives
+			if pingTime > c.lastPong.Load() {
+				continue
+			}
+
+			if c.writeErr() != nil {
+				return
+			}
+
+			pingTime = time.Now().UnixNano()
+
+			if !pongTimer.Stop() {
+				select {
+				case <-pongTimer.C:
+				default:
+				}
+			}
+
+			pongTimer.Reset(timeout)
+
+			// the peer which never reads keeps the queue full, the ping waits in the pong timeout
+			frame := c.newFrame(PingMessage, nil, true, false)
+
+			select {
+			case c.WriteChan <- frame:
+			case <-c.ctx.Done():
+				ReleaseFrame(frame)
+				return
+			case <-pongTimer.C:
+				ReleaseFrame(frame)
+				c.writeClose(WebsocketStatusCodeGoingAway, "pong timeout")
+				return
+			}
+		case <-pongTimer.C:
+			// the peer is dead, the close timer tear the connection down if it never answers
+			if c.lastPong.Load() < pingTime {
+				c.writeClose(WebsocketStatusCodeGoingAway, "pong timeout")
+				return
+			}
+		}
+	}
+}
+
 func (c *Conn) writeLoop() {
+	// nothing is written after the close frame, the peer stops reading at it
+	closeWritten := false
+
 loop:
 	for {
 		select {
 		case frame := <-c.WriteChan:
-			if _, err := frame.WriteTo(c.bufferWriter); err == nil {
-				c.bufferWriter.Flush()
-			} else {
-				c.isClose = true
+			if err := c.flushFrame(frame); err != nil {
+				// the peer is gone or stuck, no close frame can be sent
+				c.setCloseError(&CloseError{Code: WebsocketStatusCodeAbnormalClosure})
+				c.setIOError(err)
+				c.isClose.Store(true)
 				c.cancel()
 				ReleaseFrame(frame)
 				break loop
 			}
 
+			closeWritten = frame.IsClose()
+
 			ReleaseFrame(frame)
 
-			if frame.IsClose() {
+			if closeWritten {
 				break loop
 			}
 		case <-c.ctx.Done():
@@ -110,64 +552,551 @@ loop:
 			break
 		}
 
-		if _, err := fr.WriteTo(c.bufferWriter); err != nil {
-			break
-		} else {
-			c.bufferWriter.Flush()
+		if !closeWritten {
+			if err := c.flushFrame(fr); err != nil {
+				closeWritten = true
+			} else {
+				closeWritten = fr.IsClose()
+			}
 		}
 
 		ReleaseFrame(fr)
 	}
 
+	close(c.writeDone)
 	c.waitGroup.Done()
 }
 
+// flushFrame write the frame to the connection in the write timeout
+func (c *Conn) flushFrame(frame *Frame) error {
+	if c.writeTimeout > 0 {
+		c.c.SetWriteDeadline(deadline(c.writeDeadline.Load(), c.writeTimeout))
+	}
+
+	if _, err := frame.WriteTo(c.bufferWriter); err != nil {
+		return err
+	}
+
+	return c.bufferWriter.Flush()
+}
+
+// SetReadDeadline set the deadline of reading from the peer, the connection is closed
+// when it is reached. A zero value means no deadline, the IdleTimeout still applies
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(unixNano(t))
+
+	return c.c.SetReadDeadline(deadline(c.readDeadline.Load(), c.idleTimeout))
+}
+
+// SetWriteDeadline set the deadline of writing to the peer, the connection is closed
+// when it is reached. A zero value means no deadline, the WriteTimeout still applies
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(unixNano(t))
+
+	return c.c.SetWriteDeadline(deadline(c.writeDeadline.Load(), c.writeTimeout))
+}
+
+// deadline return the earlier of the deadline and now plus the timeout, the
+// deadline is unix nano time and zero means no deadline as the timeout
+func deadline(deadline int64, timeout time.Duration) time.Time {
+	var t time.Time
+
+	if deadline != 0 {
+		t = time.Unix(0, deadline)
+	}
+
+	if timeout > 0 {
+		if d := time.Now().Add(timeout); t.IsZero() || d.Before(t) {
+			t = d
+		}
+	}
+
+	return t
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+// Write send p as a text message
 func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(TextMessage, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// WriteText send data as a text message
+func (c *Conn) WriteText(data []byte) error {
+	return c.WriteMessage(TextMessage, data)
+}
+
+// WriteBinary send data as a binary message
+func (c *Conn) WriteBinary(data []byte) error {
+	return c.WriteMessage(BinaryMessage, data)
+}
+
+// WriteMessage queue data as a single frame message of the message type, data is
+// copied so the caller can reuse it after return. The data message is compressed
+// when permessage-deflate is negotiated and it is not below the compression threshold
+func (c *Conn) WriteMessage(messageType FrameTypeCode, data []byte) error {
+	return c.writeMessage(messageType, data, len(data) >= c.compressionThreshold)
+}
+
+// WriteMessageWithCompression is WriteMessage but compress tells the data message is
+// compressed or not whatever its size, it is never compressed without permessage-deflate
+func (c *Conn) WriteMessageWithCompression(messageType FrameTypeCode, data []byte, compress bool) error {
+	return c.writeMessage(messageType, data, compress)
+}
+
+func (c *Conn) writeMessage(messageType FrameTypeCode, data []byte, compress bool) error {
+	if err := checkMessage(messageType, data); err != nil {
+		return err
+	}
+
+	// control frames can be injected in the middle of a message from NextWriter
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return c.sendFrame(messageType, data, true, false)
+	}
+
+	c.messageMutex.Lock()
+	defer c.messageMutex.Unlock()
+
+	compress = compress && c.compressor != nil
+
+	if compress {
+		if err := c.writeErr(); err != nil {
+			return err
+		}
+
+		payload, err := c.compressor.compress(data)
+
+		if err != nil {
+			return err
+		}
+
+		data = payload
+	}
+
+	return c.sendFrame(messageType, data, true, compress)
+}
+
+// NextWriter return a writer of a message of the message type, the data written is
+// sent in frames of the write buffer size and the last frame is sent by Close. The
+// other data messages wait until the writer is closed, so it must always be closed.
+// The message is compressed when permessage-deflate is negotiated
+func (c *Conn) NextWriter(messageType FrameTypeCode) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, ErrInvalidMessageType
+	}
+
+	if err := c.writeErr(); err != nil {
+		return nil, err
+	}
+
+	c.messageMutex.Lock()
+
+	w := newMessageWriter(c, messageType, c.bufferWriter.Size())
+
+	if c.compressor == nil {
+		return w, nil
+	}
+
+	cw, err := newCompressedWriter(w, c.compressor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cw, nil
+}
+
+func (c *Conn) sendFrame(frameType FrameTypeCode, payload []byte, isFin bool, compressed bool) error {
+	if err := c.writeErr(); err != nil {
+		return err
+	}
 
+	frame := c.newFrame(frameType, payload, isFin, compressed)
+
+	select {
+	case c.WriteChan <- frame:
+		return nil
+	default:
+	}
+
+	// the full queue is never drained once the connection ends
+	select {
+	case c.WriteChan <- frame:
+		return nil
+	case <-c.ctx.Done():
+		ReleaseFrame(frame)
+		return ErrConnClosed
+	}
+}
+
+// newFrame return the frame of the payload ready to be queued, the payload is copied
+func (c *Conn) newFrame(frameType FrameTypeCode, payload []byte, isFin bool, compressed bool) *Frame {
 	frame := AcquireFrame()
 
-	frame.SetFrameType(codeText)
-	frame.SetPayload(p)
-	frame.SetFin()
-	frame.SetPayloadSize(int64(len(p)))
+	frame.SetFrameType(frameType)
+	frame.SetPayload(append(frame.payload[:0], payload...))
+	frame.SetPayloadSize(int64(len(payload)))
+	frame.rsv1 = compressed
 
-	if c.isClose {
-		return 0, fmt.Errorf("conn is closed")
+	if isFin {
+		frame.SetFin()
 	}
 
-	c.WriteChan <- frame
+	// the frames of the client are masked
+	if !c.isServer {
+		frame.SetMask()
+	}
 
-	return len(p), nil
+	return frame
+}
+
+func (c *Conn) endMessage() {
+	c.messageMutex.Unlock()
+}
+
+// NextReader return the type and the reader of the next data message, the frames of
+// the message are read as they arrive so the message is never fully buffered. The
+// rest of the previous message is dropped, the control frames are handled on the way.
+// It is used by the ConnHandler of the Server, it must not be used with MessageHandler
+func (c *Conn) NextReader() (FrameTypeCode, io.Reader, error) {
+	if c.nextReader != nil {
+		r := c.nextReader
+		c.nextReader = nil
+
+		if err := r.discard(); err != nil {
+			return codeUnknown, nil, err
+		}
+	}
+
+	frame, err := c.nextDataFrame()
+
+	if err != nil {
+		return codeUnknown, nil, err
+	}
+
+	frameType := frame.frameType
+
+	r, err := newNextReader(c, frame, &c.message)
+
+	if err != nil {
+		return codeUnknown, nil, err
+	}
+
+	c.nextReader = r
+
+	return frameType, r, nil
+}
+
+// nextDataFrame return the next data frame from ReadChan, the control frames before it are handled
+func (c *Conn) nextDataFrame() (*Frame, error) {
+	for {
+		if err := c.readErr(); err != nil {
+			return nil, err
+		}
+
+		var frame *Frame
+
+		select {
+		case frame = <-c.ReadChan:
+		case <-c.ctx.Done():
+			// the frames read before the connection ended come first
+			select {
+			case frame = <-c.ReadChan:
+			default:
+				if err := c.readErr(); err != nil {
+					return nil, err
+				}
+
+				return nil, ErrConnClosed
+			}
+		}
+
+		if !frame.IsControl() {
+			return frame, nil
+		}
+
+		c.handleControl(frame)
+		ReleaseFrame(frame)
+	}
+}
+
+// readErr return the error of reading on the conn, the CloseError of the peer comes first
+func (c *Conn) readErr() error {
+	if closeErr := c.closeError(); closeErr != nil {
+		return closeErr
+	}
+
+	return c.Err()
+}
+
+// handleControl handle the control frame from the peer, the close frame is answered
+// and becomes the CloseError of the reads and the writes after it
+func (c *Conn) handleControl(frame *Frame) {
+	switch frame.frameType {
+	case codeClose:
+		closeErr, err := parseCloseFrame(frame, c.message.validateUTF8)
+
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		c.setCloseError(closeErr)
+
+		// echo the status code of the peer back, nothing is sent when the conn closed first
+		c.writeClose(closeErr.Code, "")
+	case codePing:
+		// the ping is answered with the same payload unless the handler takes over
+		if c.pingHandler != nil {
+			c.pingHandler(c, frame.payload)
+		} else {
+			c.Pong(frame.payload)
+		}
+	case codePong:
+		if c.pongHandler != nil {
+			c.pongHandler(c, frame.payload)
+		}
+	}
+}
+
+// writeErr return the error of writing on the conn, the CloseError of the peer
+// comes first after the close frame from the peer is received
+func (c *Conn) writeErr() error {
+	if closeErr := c.closeError(); closeErr != nil {
+		return closeErr
+	}
+
+	if c.closeSent.Load() {
+		return ErrCloseSent
+	}
+
+	if c.isClose.Load() {
+		return ErrConnClosed
+	}
+
+	return nil
 }
 
-func (c *Conn) Close() {
+// Close start the close handshake with WebsocketStatusCodeNormalClosure
+func (c *Conn) Close() error {
+	return c.CloseWithReason(WebsocketStatusCodeNormalClosure, "")
+}
+
+// CloseWithReason start the close handshake with the status code and the reason,
+// the connection is force closed when the peer does not answer in the close timeout
+func (c *Conn) CloseWithReason(code WebsocketStatusCode, reason string) error {
+	if !code.isValid() {
+		return ErrCloseCodeNotAllowed
+	}
+
+	if len(reason) > maxCloseReasonSize {
+		return ErrCloseReasonTooLong
+	}
+
+	if !c.writeClose(code, reason) {
+		return ErrCloseSent
+	}
+
+	return nil
+}
+
+// writeClose queue the close frame only once and start the timer force closing
+// the connection, it report the close handshake is started by this call or not. The
+// timer starts first, the close frame is dropped when the full queue is not drained in time
+func (c *Conn) writeClose(code WebsocketStatusCode, reason string) bool {
+	if !c.closeSent.CompareAndSwap(false, true) {
+		return false
+	}
+
+	timeout := make(chan struct{})
+
+	c.mutex.Lock()
+	c.closeTimer = time.AfterFunc(c.closeTimeout, func() {
+		close(timeout)
+		c.c.Close()
+	})
+	c.mutex.Unlock()
 
 	frame := AcquireFrame()
 
-	frame.SetStatus(websocketStatusCodeNormalClosure)
+	frame.SetCloseReason(code, reason)
 	frame.SetFrameType(codeClose)
 	frame.SetFin()
 
-	c.WriteChan <- frame
+	if !c.isServer {
+		frame.SetMask()
+	}
 
+	select {
+	case c.WriteChan <- frame:
+		return true
+	default:
+	}
+
+	// the peer which never reads keeps the queue full
+	select {
+	case c.WriteChan <- frame:
+	case <-c.ctx.Done():
+		ReleaseFrame(frame)
+	case <-timeout:
+		ReleaseFrame(frame)
+	}
+
+	return true
 }
 
-func (c *Conn) Ping() {
-	frame := AcquireFrame()
+func (c *Conn) stopCloseTimer() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	frame.SetFrameType(codePing)
-	frame.SetFin()
+	if c.closeTimer != nil {
+		c.closeTimer.Stop()
+	}
+}
 
-	c.WriteChan <- frame
+// closeError return the CloseError of the peer, nil before the connection is closed
+func (c *Conn) closeError() *CloseError {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.closeErr
 }
 
-func (c *Conn) Pong() {
-	frame := AcquireFrame()
+// closeStatus return the close frame from the peer, it is WebsocketStatusCodeAbnormalClosure without close frame
+func (c *Conn) closeStatus() *CloseError {
+	if closeErr := c.closeError(); closeErr != nil {
+		return closeErr
+	}
 
-	frame.SetFrameType(codePong)
-	frame.SetFin()
+	return &CloseError{Code: WebsocketStatusCodeAbnormalClosure}
+}
 
-	c.WriteChan <- frame
+// setCloseError keep the first CloseError, the later one of the tear down is ignored
+func (c *Conn) setCloseError(closeErr *CloseError) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closeErr == nil {
+		c.closeErr = closeErr
+	}
+}
+
+// Subprotocol return the Sec-WebSocket-Protocol selected by the server, it is empty when none is selected
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// ID return the unique ID of the conn
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// closing tells the close handshake started or the connection is gone
+func (c *Conn) closing() bool {
+	return c.closeSent.Load() || c.isClose.Load()
+}
+
+// Header return the header of the opening handshake of the client, only the RequestHeaders
+// of the server are kept when they are set. It is nil when the conn is not upgraded by Upgrade
+func (c *Conn) Header() http.Header {
+	return c.request.header
+}
+
+// Path return the path of the opening handshake of the client
+func (c *Conn) Path() string {
+	return c.request.path
+}
+
+// Query return the query args of the opening handshake of the client
+func (c *Conn) Query() url.Values {
+	return c.request.query
+}
+
+// Cookies return the cookies of the opening handshake of the client
+func (c *Conn) Cookies() []*http.Cookie {
+	return c.request.cookies
+}
+
+// RemoteAddr return the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.c.RemoteAddr()
+}
+
+// LocalAddr return the local address of the connection
+func (c *Conn) LocalAddr() net.Addr {
+	return c.c.LocalAddr()
+}
+
+// ConnectionState return the state of the TLS connection, ok is false when the connection is not TLS
+func (c *Conn) ConnectionState() (state tls.ConnectionState, ok bool) {
+	if c.request.tlsState != nil {
+		return *c.request.tlsState, true
+	}
+
+	if tlsConn, ok := c.c.(*tls.Conn); ok {
+		return tlsConn.ConnectionState(), true
+	}
+
+	return tls.ConnectionState{}, false
+}
+
+// Locals return the values attached to the connection, like the user values of the
+// fasthttp.RequestCtx and the values set by BeforeUpgrade
+func (c *Conn) Locals() *Locals {
+	return c.locals
+}
+
+// Err return the protocol, read or write error which failed the connection, nil when the connection is fine
+func (c *Conn) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.err
+}
+
+// fail record the error and send the close frame with the status matching the error
+func (c *Conn) fail(err error) {
+	c.setErr(err)
+
+	c.writeClose(statusForError(err), "")
+}
+
+// setIOError record the read or write error of the connection, closing the connection
+// by the tear down is not an error
+func (c *Conn) setIOError(err error) {
+	if !errors.Is(err, net.ErrClosed) {
+		c.setErr(err)
+	}
+}
+
+// setErr keep the first error which failed the connection
+func (c *Conn) setErr(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// Ping send a ping without payload
+func (c *Conn) Ping() error {
+	return c.WriteMessage(PingMessage, nil)
+}
+
+// Pong send a pong, data should be the payload of the ping it answers
+func (c *Conn) Pong(data []byte) error {
+	return c.WriteMessage(PongMessage, data)
 }
 
 func (c *Conn) writeFrame(frame *Frame) {
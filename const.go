@@ -6,33 +6,47 @@ var (
 	connectionString             = []byte("Connection")
 	websocketProtocolString      = []byte("Sec-WebSocket-Protocol")
 	websocketKeyString           = []byte("Sec-WebSocket-Key")
-	secWebsocketKeyValueString   = []byte("dGhlIHNhbXBsZSBub25jZQ==")
 	websocketVersionString       = []byte("Sec-WebSocket-Version")
 	websocketAcceptVersionString = []byte("13")
 	websocketAcceptString        = []byte("Sec-WebSocket-Accept")
+	websocketExtensionsString    = []byte("Sec-WebSocket-Extensions")
+	permessageDeflateString      = []byte("permessage-deflate")
 	getString                    = []byte("GET")
 	originString                 = []byte("Origin")
+	authorizationString          = []byte("Authorization")
 )
 
-type frameTypeCode uint8
+// FrameTypeCode is the opcode of the frame, it is also the type of the message
+type FrameTypeCode uint8
 
 const (
-	codeContinuation frameTypeCode = 0x0
+	codeContinuation FrameTypeCode = 0x0
 
-	codeText frameTypeCode = 0x1
+	codeText FrameTypeCode = 0x1
 
-	codeBinary frameTypeCode = 0x2
+	codeBinary FrameTypeCode = 0x2
 
-	codeClose frameTypeCode = 0x8
+	codeClose FrameTypeCode = 0x8
 
-	codePing frameTypeCode = 0x9
+	codePing FrameTypeCode = 0x9
 
-	codePong frameTypeCode = 0xA
+	codePong FrameTypeCode = 0xA
 
-	codeUnknown frameTypeCode = 0xFF
+	codeUnknown FrameTypeCode = 0xFF
 )
 
-func (f frameTypeCode) String() string {
+// the message types used by WriteMessage and returned by Client.Read
+const (
+	TextMessage = codeText
+
+	BinaryMessage = codeBinary
+
+	PingMessage = codePing
+
+	PongMessage = codePong
+)
+
+func (f FrameTypeCode) String() string {
 	switch f {
 	case codeContinuation:
 		return "Continuation"
@@ -51,57 +65,104 @@ func (f frameTypeCode) String() string {
 	}
 }
 
-type websocketStatusCode uint16
+// WebsocketStatusCode is the status code of the close frame defined by RFC 6455 section 7.4
+type WebsocketStatusCode uint16
 
 const (
-	websocketStatusCodeNormalClosure websocketStatusCode = 1000
+	WebsocketStatusCodeNormalClosure WebsocketStatusCode = 1000
+
+	WebsocketStatusCodeGoingAway WebsocketStatusCode = 1001
+
+	WebsocketStatusCodeProtocolError WebsocketStatusCode = 1002
+
+	WebsocketStatusCodeUnsupportedData WebsocketStatusCode = 1003
+
+	// WebsocketStatusCodeNoStatusReceived means the close frame has no status code, it must not be sent
+	WebsocketStatusCodeNoStatusReceived WebsocketStatusCode = 1005
+
+	// WebsocketStatusCodeAbnormalClosure means the connection is closed without close frame, it must not be sent
+	WebsocketStatusCodeAbnormalClosure WebsocketStatusCode = 1006
 
-	websocketStatusCodeGoingAway = 1001
+	WebsocketStatusCodeInvalidFramePayloadData WebsocketStatusCode = 1007
 
-	websocketStatusCodeProtocolError = 1002
+	WebsocketStatusCodePolicyViolation WebsocketStatusCode = 1008
 
-	websocketStatusCodeUnsupportedData = 1003
+	WebsocketStatusCodeMessageTooBig WebsocketStatusCode = 1009
 
-	websocketStatusCodeNoStatusReceived = 1005
+	WebsocketStatusCodeMandatoryExtension WebsocketStatusCode = 1010
 
-	websocketStatusCodeAbnormalClosure = 1006
+	WebsocketStatusCodeInternalServerError WebsocketStatusCode = 1011
 
-	websocketStatusCodeInvalidFramePayloadData = 1007
+	WebsocketStatusCodeServiceRestart WebsocketStatusCode = 1012
 
-	websocketStatusCodePolicyViolation = 1008
+	WebsocketStatusCodeTryAgainLater WebsocketStatusCode = 1013
 
-	websocketStatusCodeMessageTooBig = 1009
+	WebsocketStatusCodeBadGateway WebsocketStatusCode = 1014
 
-	websocketStatusCodeMandatoryExtension = 1010
+	// WebsocketStatusCodeTLSHandshake means the TLS handshake failed, it must not be sent
+	WebsocketStatusCodeTLSHandshake WebsocketStatusCode = 1015
 
-	websocketStatusCodeInternalServerError = 1011
+	// the status codes in the range are free for the application to use
+	WebsocketStatusCodeApplicationMin WebsocketStatusCode = 4000
+	WebsocketStatusCodeApplicationMax WebsocketStatusCode = 4999
 )
 
-func (s websocketStatusCode) String() string {
+func (s WebsocketStatusCode) String() string {
 	switch s {
-	case websocketStatusCodeNormalClosure:
+	case WebsocketStatusCodeNormalClosure:
 		return "NormalClosure"
-	case websocketStatusCodeGoingAway:
+	case WebsocketStatusCodeGoingAway:
 		return "GoingAway"
-	case websocketStatusCodeProtocolError:
+	case WebsocketStatusCodeProtocolError:
 		return "ProtocolError"
-	case websocketStatusCodeUnsupportedData:
+	case WebsocketStatusCodeUnsupportedData:
 		return "UnsupportedData"
-	case websocketStatusCodeNoStatusReceived:
+	case WebsocketStatusCodeNoStatusReceived:
 		return "NoStatusReceived"
-	case websocketStatusCodeAbnormalClosure:
+	case WebsocketStatusCodeAbnormalClosure:
 		return "AbnormalClosure"
-	case websocketStatusCodeInvalidFramePayloadData:
+	case WebsocketStatusCodeInvalidFramePayloadData:
 		return "InvalidFramePayloadData"
-	case websocketStatusCodePolicyViolation:
+	case WebsocketStatusCodePolicyViolation:
 		return "PolicyViolation"
-	case websocketStatusCodeMessageTooBig:
+	case WebsocketStatusCodeMessageTooBig:
 		return "MessageTooBig"
-	case websocketStatusCodeMandatoryExtension:
+	case WebsocketStatusCodeMandatoryExtension:
 		return "MandatoryExtension"
-	case websocketStatusCodeInternalServerError:
+	case WebsocketStatusCodeInternalServerError:
 		return "InternalServerError"
-	default:
-		return "Unknown"
+	case WebsocketStatusCodeServiceRestart:
+		return "ServiceRestart"
+	case WebsocketStatusCodeTryAgainLater:
+		return "TryAgainLater"
+	case WebsocketStatusCodeBadGateway:
+		return "BadGateway"
+	case WebsocketStatusCodeTLSHandshake:
+		return "TLSHandshake"
+	}
+
+	if s.IsApplication() {
+		return "Application"
 	}
+
+	return "Unknown"
+}
+
+// IsApplication report the status code is in the 4000-4999 application range
+func (s WebsocketStatusCode) IsApplication() bool {
+	return s >= WebsocketStatusCodeApplicationMin && s <= WebsocketStatusCodeApplicationMax
+}
+
+// isValid report the status code can be put in a close frame on the wire
+func (s WebsocketStatusCode) isValid() bool {
+	switch {
+	case s >= WebsocketStatusCodeNormalClosure && s <= WebsocketStatusCodeUnsupportedData:
+		return true
+	case s >= WebsocketStatusCodeInvalidFramePayloadData && s <= WebsocketStatusCodeBadGateway:
+		return true
+	case s >= 3000 && s <= WebsocketStatusCodeApplicationMax:
+		return true
+	}
+
+	return false
 }
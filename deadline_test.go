@@ -0,0 +1,168 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_ServerIdleTimeout(t *testing.T) {
+	wsServer := &Server{
+		IdleTimeout: 100 * time.Millisecond,
+	}
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// the traffic keeps the connection alive
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		client.WriteMessage(PingMessage, nil)
+
+		if _, _, err := client.Read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+
+	_, _, err = client.Read()
+
+	closeErr, ok := err.(*CloseError)
+
+	if !ok || closeErr.Code != WebsocketStatusCodeGoingAway {
+		t.Fatalf("expected going away close, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("connection closed too early: %v", elapsed)
+	}
+}
+
+func Test_ConnReadDeadline(t *testing.T) {
+	wsServer := &Server{}
+
+	readErrs := make(chan error, 1)
+
+	wsServer.SetConnHandler(func(c *Conn) {
+		c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+		_, _, err := c.NextReader()
+		readErrs <- err
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err = client.Read()
+
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != WebsocketStatusCodeGoingAway {
+		t.Errorf("expected going away close, got %v", err)
+	}
+
+	if closeErr, ok := (<-readErrs).(*CloseError); !ok || closeErr.Code != WebsocketStatusCodeAbnormalClosure {
+		t.Errorf("expected abnormal closure on the server, got %v", closeErr)
+	}
+}
+
+func Test_ClientReadDeadline(t *testing.T) {
+	wsServer := &Server{}
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	if _, _, err := client.Read(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	if _, _, err := client.Read(); err == nil {
+		t.Error("the connection should be closed after the read timeout")
+	}
+}
+
+func Test_ServerWriteTimeout(t *testing.T) {
+	for name, wsServer := range map[string]*Server{
+		"WriteTimeout":     {WriteTimeout: 100 * time.Millisecond},
+		"SetWriteDeadline": {},
+	} {
+		errs := make(chan error, 1)
+		codes := make(chan WebsocketStatusCode, 1)
+
+		wsServer.OnOpen(func(c *Conn) {
+			if wsServer.WriteTimeout == 0 {
+				c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			}
+
+			c.WriteText([]byte("nobody reads"))
+		})
+
+		wsServer.OnError(func(c *Conn, err error) {
+			errs <- err
+		})
+
+		wsServer.OnClose(func(c *Conn, code WebsocketStatusCode, reason string) {
+			codes <- code
+		})
+
+		// the client stalls, it never reads the pipe
+		serverSide, clientSide := net.Pipe()
+
+		go wsServer.ServeConn(serverSide)
+
+		select {
+		case code := <-codes:
+			if code != WebsocketStatusCodeAbnormalClosure {
+				t.Errorf("%s: expected %v, got %v", name, WebsocketStatusCodeAbnormalClosure, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the stalled connection was not closed", name)
+		}
+
+		if err := <-errs; !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%s: expected deadline exceeded, got %v", name, err)
+		}
+
+		clientSide.Close()
+	}
+}
+
+func Test_ClientWriteDeadline(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+
+	// the server stalls, it never reads the pipe
+	client := NewClientConn(clientSide)
+
+	client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+
+	if err := client.WriteText([]byte("nobody reads")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	_, _, err := client.Read()
+
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != WebsocketStatusCodeAbnormalClosure {
+		t.Errorf("expected %v, got %v", WebsocketStatusCodeAbnormalClosure, err)
+	}
+
+	if err := client.WriteText([]byte("after the timeout")); !errors.As(err, new(*CloseError)) {
+		t.Errorf("expected close error, got %v", err)
+	}
+}
@@ -0,0 +1,511 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	// ErrBadScheme shows up when the url to dial is not a websocket url
+	ErrBadScheme = errors.New("websocket: url scheme must be ws, wss or ws+unix")
+
+	// ErrBadUnixURL shows up when the ws+unix url has no socket path
+	ErrBadUnixURL = errors.New("websocket: ws+unix url must be like ws+unix:///path/to/socket:/request/path")
+)
+
+// handshakeErrorBodySize is the max size of the body kept in the HandshakeError
+const handshakeErrorBodySize = 1024
+
+// Dialer is the settings of connecting to a websocket server
+type Dialer struct {
+	// HandshakeTimeout is the time limit of dialing and the opening handshake,
+	// there is no limit other than the context when it is zero
+	HandshakeTimeout time.Duration
+
+	// Origin, Host and UserAgent are the headers of the opening handshake when they
+	// are set, Host is the host of the url by default
+	Origin    string
+	Host      string
+	UserAgent string
+
+	// ReadBufferSize and WriteBufferSize are the sizes of the buffers of the connection,
+	// default is 4096. The frames bigger than the read buffer are read in chunks
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// EnableCompression offer permessage-deflate to the server
+	EnableCompression bool
+
+	// Subprotocols are the Sec-WebSocket-Protocol offered to the server in the order of
+	// preference, the handshake fails when the server selects one which is not offered
+	Subprotocols []string
+
+	// TLSClientConfig is the TLS settings of the wss url like the root CAs and the client
+	// certificates, the ServerName is the host of the url when it is not set
+	TLSClientConfig *tls.Config
+
+	// Proxy return the proxy of the request to the server, the ws url is asked as
+	// http and the wss url as https. The proxy url scheme http or https is an HTTP
+	// CONNECT proxy and socks5 or socks5h a SOCKS5 proxy, socks5 resolves the host
+	// locally and socks5h lets the proxy resolve it. The user info of the proxy url
+	// is the proxy auth. No proxy is used when it is nil or returns nil
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// NetDialContext dial the connection to the server or the proxy, the network is
+	// tcp or unix for the ws+unix url. Default is net.Dialer.DialContext
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// MaxRedirects is the max number of the 301, 302, 307 and 308 redirects followed by
+	// the opening handshake, default is 10. A negative value means no redirect is followed
+	MaxRedirects int
+
+	// CheckRedirect is called before following the redirect to req.URL with the ws or
+	// wss scheme, via are the requests already sent, the first one first. The redirect
+	// is not followed and its error is returned when it returns an error
+	CheckRedirect func(req *http.Request, via []*http.Request) error
+
+	// Jar send its cookies of the url on the opening handshake and keep the cookies
+	// set by the 101 response, the ws url is asked as http and the wss url as https
+	Jar http.CookieJar
+}
+
+// DefaultDialer is the Dialer of NewClient, the proxy is taken from the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+var DefaultDialer = &Dialer{
+	HandshakeTimeout:  45 * time.Second,
+	EnableCompression: true,
+	Proxy:             http.ProxyFromEnvironment,
+}
+
+// Dial is DialContext with the background context
+func (d *Dialer) Dial(url string, header http.Header) (*Client, error) {
+	return d.DialContext(context.Background(), url, header)
+}
+
+// DialContext connect to the websocket server of the url, header is added to the
+// opening handshake. The context only limits dialing and the opening handshake
+func (d *Dialer) DialContext(ctx context.Context, rawURL string, header http.Header) (*Client, error) {
+	u, err := url.Parse(rawURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "ws" && u.Scheme != "wss" && u.Scheme != "ws+unix" {
+		return nil, ErrBadScheme
+	}
+
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+
+	req := &http.Request{Method: http.MethodGet, URL: u, Header: header, Host: u.Host}
+
+	var via []*http.Request
+
+	for {
+		client, err := d.dial(ctx, req.URL, req.Header)
+
+		location, ok := redirectLocation(err)
+
+		if !ok || d.MaxRedirects < 0 {
+			if err != nil {
+				return nil, err
+			}
+
+			client.url = req.URL
+
+			return client, nil
+		}
+
+		via = append(via, req)
+
+		if req, err = d.redirect(location, via); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// dial connect to the websocket server of the url and send the opening handshake
+func (d *Dialer) dial(ctx context.Context, u *url.URL, header http.Header) (*Client, error) {
+	// the ws+unix url is rewritten by target
+	u = &url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: u.Path, RawQuery: u.RawQuery}
+
+	network, addr, dialAddr, proxy, err := d.target(u)
+
+	if err != nil {
+		return nil, err
+	}
+
+	netDialContext := d.NetDialContext
+
+	if netDialContext == nil {
+		netDialer := &net.Dialer{}
+		netDialContext = netDialer.DialContext
+	}
+
+	c, err := netDialContext(ctx, network, dialAddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stop := watchContext(ctx, c)
+
+	client, err := d.open(ctx, c, u, header, proxy, addr)
+
+	stop()
+
+	if err != nil {
+		c.Close()
+
+		// the handshake fails by the deadline of the context, the deadline of the
+		// connection can be hit before the context knows it
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+
+		return nil, err
+	}
+
+	c.SetDeadline(time.Time{})
+
+	return client, nil
+}
+
+// target return the network and the address of the server and the address to dial
+// which is the proxy when it is used. The ws+unix url is turned into the ws url of
+// the request on the socket
+func (d *Dialer) target(u *url.URL) (network, addr, dialAddr string, proxy *url.URL, err error) {
+	if u.Scheme == "ws+unix" {
+		socket, path, err := splitUnixURL(u)
+
+		if err != nil {
+			return "", "", "", nil, err
+		}
+
+		*u = url.URL{Scheme: "ws", User: u.User, Host: "localhost", Path: path, RawQuery: u.RawQuery}
+
+		return "unix", socket, socket, nil, nil
+	}
+
+	port := u.Port()
+
+	if port == "" {
+		port = "80"
+
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+
+	addr = net.JoinHostPort(u.Hostname(), port)
+
+	if proxy, err = d.proxyURL(u); err != nil {
+		return "", "", "", nil, err
+	}
+
+	dialAddr = addr
+
+	if proxy != nil {
+		if dialAddr, err = proxyAddr(proxy); err != nil {
+			return "", "", "", nil, err
+		}
+	}
+
+	return "tcp", addr, dialAddr, proxy, nil
+}
+
+// splitUnixURL split the path of the ws+unix url like ws+unix:///tmp/app.sock:/ws into the
+// socket path and the request path, the request path is / when it is missing. The url
+// has no host, the socket path goes right after the scheme
+func splitUnixURL(u *url.URL) (socket, path string, err error) {
+	socket, path, _ = strings.Cut(u.Path, ":")
+
+	if u.Host != "" || socket == "" {
+		return "", "", ErrBadUnixURL
+	}
+
+	if path == "" {
+		path = "/"
+	}
+
+	return socket, path, nil
+}
+
+// open tunnel through the proxy when it is set, start TLS for the wss url and
+// send the opening handshake on the connection to the address
+func (d *Dialer) open(ctx context.Context, c net.Conn, u *url.URL, header http.Header, proxy *url.URL, addr string) (*Client, error) {
+	var err error
+
+	if proxy != nil {
+		if c, err = connectProxy(ctx, c, proxy, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if u.Scheme == "wss" {
+		if c, err = d.tlsHandshake(ctx, c, u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+
+	return d.handshake(c, u, header)
+}
+
+// watchContext apply the deadline and the cancel of the context to the connection until stop is called
+func watchContext(ctx context.Context, c net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	// the cancel of the context interrupts the handshake by a deadline in the past
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// tlsHandshake start TLS on the connection to the server
+func (d *Dialer) tlsHandshake(ctx context.Context, c net.Conn, hostname string) (net.Conn, error) {
+	config := &tls.Config{}
+
+	if d.TLSClientConfig != nil {
+		config = d.TLSClientConfig.Clone()
+	}
+
+	if config.ServerName == "" {
+		config.ServerName = hostname
+	}
+
+	tlsConn := tls.Client(c, config)
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// handshake send the opening handshake on the connection and check the response of the server
+func (d *Dialer) handshake(c net.Conn, u *url.URL, header http.Header) (*Client, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	key, err := generateChallengeKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	host := u.Host
+
+	if d.Host != "" {
+		host = d.Host
+	}
+
+	req.Header.SetMethod("GET")
+	req.Header.SetRequestURI(u.RequestURI())
+	req.Header.SetHost(host)
+
+	if d.Origin != "" {
+		req.Header.SetBytesK(originString, d.Origin)
+	}
+
+	if d.UserAgent != "" {
+		req.Header.SetUserAgent(d.UserAgent)
+	}
+
+	// the user info of the url is the Basic auth unless the header has its own
+	if u.User != nil && header.Get("Authorization") == "" {
+		req.Header.SetBytesK(authorizationString, basicAuth(u.User))
+	}
+
+	if d.Jar != nil {
+		for _, cookie := range d.Jar.Cookies(httpURL(u)) {
+			req.Header.SetCookie(cookie.Name, cookie.Value)
+		}
+	}
+
+	req.Header.SetBytesKV(connectionString, upgradeString)
+	req.Header.SetBytesKV(upgradeString, webSocketString)
+	req.Header.SetBytesKV(websocketVersionString, websocketAcceptVersionString)
+	req.Header.SetBytesKV(websocketKeyString, key)
+
+	if d.EnableCompression {
+		req.Header.SetBytesKV(websocketExtensionsString, permessageDeflateString)
+	}
+
+	if len(d.Subprotocols) > 0 {
+		req.Header.SetBytesK(websocketProtocolString, strings.Join(d.Subprotocols, ", "))
+	}
+
+	br := newBufioReader(c, d.ReadBufferSize)
+	bw := newBufioWriter(c, d.WriteBufferSize)
+
+	if err := req.Write(bw); err != nil {
+		return nil, err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	// the body of the refused handshake is read by handshakeError up to its limit
+	resp.SkipBody = true
+
+	if err := resp.Read(br); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != fasthttp.StatusSwitchingProtocols {
+		err := handshakeError(&resp.Header, br)
+
+		// the cookies of the redirect go on to the next hop
+		if d.Jar != nil && len(err.Cookies) > 0 {
+			d.Jar.SetCookies(httpURL(u), err.Cookies)
+		}
+
+		return nil, err
+	}
+
+	accept := resp.Header.PeekBytes(websocketAcceptString)
+
+	if expected := computeAcceptKey(key); !bytes.Equal(accept, expected) {
+		return nil, &AcceptKeyError{Key: string(key), Accept: string(accept)}
+	}
+
+	subprotocol := string(resp.Header.PeekBytes(websocketProtocolString))
+
+	// the server cannot select the subprotocol which is not offered
+	if subprotocol != "" && !containsToken(d.Subprotocols, subprotocol) {
+		return nil, &SubprotocolError{Subprotocol: subprotocol}
+	}
+
+	extensions := string(resp.Header.PeekBytes(websocketExtensionsString))
+
+	// the server cannot accept the extension which is not offered
+	if !d.EnableCompression && extensions != "" {
+		return nil, ErrInvalidExtension
+	}
+
+	params, err := parseCompressionResponse(extensions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		c:              c,
+		rwBuffer:       bufio.NewReadWriter(br, bw),
+		reader:         frameReader{chunkSize: int64(br.Size())},
+		responseHeader: httpHeader(&resp.Header),
+		subprotocol:    subprotocol,
+	}
+
+	if d.Jar != nil {
+		if cookies := (&http.Response{Header: client.responseHeader}).Cookies(); len(cookies) > 0 {
+			d.Jar.SetCookies(httpURL(u), cookies)
+		}
+	}
+
+	if params != nil {
+		client.enableCompression(params)
+	}
+
+	return client, nil
+}
+
+// handshakeError return the HandshakeError of the response refusing the upgrade
+// with the first handshakeErrorBodySize bytes of its body
+func handshakeError(header *fasthttp.ResponseHeader, br *bufio.Reader) *HandshakeError {
+	err := &HandshakeError{
+		StatusCode: header.StatusCode(),
+		Header:     httpHeader(header),
+	}
+
+	err.Cookies = (&http.Response{Header: err.Header}).Cookies()
+
+	var body io.Reader
+
+	switch contentLength := header.ContentLength(); {
+	case contentLength >= 0:
+		body = io.LimitReader(br, int64(contentLength))
+	case contentLength == -1:
+		body = httputil.NewChunkedReader(br)
+	default:
+		// the body ends with the connection
+		body = br
+	}
+
+	// the body is only a hint of the refusal, the read error is not reported
+	err.Body, _ = io.ReadAll(io.LimitReader(body, handshakeErrorBodySize))
+
+	return err
+}
+
+// httpHeader copy the response header with the Set-Cookie values
+func httpHeader(header *fasthttp.ResponseHeader) http.Header {
+	h := http.Header{}
+
+	header.VisitAll(func(key, value []byte) {
+		h.Add(string(key), string(value))
+	})
+
+	return h
+}
+
+func newBufioReader(c net.Conn, size int) *bufio.Reader {
+	if size > 0 {
+		return bufio.NewReaderSize(c, size)
+	}
+
+	return bufio.NewReader(c)
+}
+
+func newBufioWriter(c net.Conn, size int) *bufio.Writer {
+	if size > 0 {
+		return bufio.NewWriterSize(c, size)
+	}
+
+	return bufio.NewWriter(c)
+}
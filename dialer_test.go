@@ -0,0 +1,566 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newRawTestServer accept the connections on a random local port and let handle answer
+// the opening handshake by itself, it return the ws url
+func newRawTestServer(t *testing.T, handle func(c net.Conn, req *fasthttp.Request)) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				req := fasthttp.AcquireRequest()
+				defer fasthttp.ReleaseRequest(req)
+
+				if err := req.Read(bufio.NewReader(c)); err != nil {
+					return
+				}
+
+				handle(c, req)
+			}()
+		}
+	}()
+
+	return "ws://" + ln.Addr().String() + "/ws"
+}
+
+func Test_DialerHeaders(t *testing.T) {
+	requests := make(chan *fasthttp.RequestHeader, 2)
+
+	wsServer := &Server{
+		CheckOrigin: func(ctx *fasthttp.RequestCtx) bool {
+			header := &fasthttp.RequestHeader{}
+			ctx.Request.Header.CopyTo(header)
+			requests <- header
+			return true
+		},
+	}
+
+	url := newTestServer(t, wsServer)
+
+	dialer := &Dialer{
+		HandshakeTimeout: 5 * time.Second,
+		Origin:           "http://example.com",
+		Host:             "example.com",
+		UserAgent:        "test-agent",
+		ReadBufferSize:   1024,
+		WriteBufferSize:  2048,
+	}
+
+	header := http.Header{}
+	header.Set("X-Token", "secret")
+
+	var keys []string
+
+	for i := 0; i < 2; i++ {
+		client, err := dialer.DialContext(context.Background(), url, header)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if client.rwBuffer.Reader.Size() != 1024 || client.rwBuffer.Writer.Size() != 2048 {
+			t.Errorf("unexpected buffer sizes %d %d", client.rwBuffer.Reader.Size(), client.rwBuffer.Writer.Size())
+		}
+
+		if client.compressor != nil {
+			t.Error("compression is not offered")
+		}
+
+		client.Close()
+
+		req := <-requests
+
+		if string(req.Peek("Origin")) != "http://example.com" || string(req.Host()) != "example.com" ||
+			string(req.UserAgent()) != "test-agent" || string(req.Peek("X-Token")) != "secret" {
+			t.Errorf("unexpected request header %s", req.Header())
+		}
+
+		keys = append(keys, string(req.PeekBytes(websocketKeyString)))
+	}
+
+	if keys[0] == keys[1] || !isValidChallengeKeys([]byte(keys[0])) {
+		t.Errorf("the key should be random, got %v", keys)
+	}
+}
+
+func Test_DialerAcceptKeyMismatch(t *testing.T) {
+	url := newRawTestServer(t, func(c net.Conn, req *fasthttp.Request) {
+		c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"))
+	})
+
+	_, err := NewClient(url)
+
+	var acceptErr *AcceptKeyError
+
+	if !errors.As(err, &acceptErr) || acceptErr.Accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("expected accept key error, got %v", err)
+	}
+}
+
+func Test_DialerHandshakeTimeout(t *testing.T) {
+	// the server never answers the handshake
+	url := newRawTestServer(t, func(c net.Conn, req *fasthttp.Request) {
+		time.Sleep(2 * time.Second)
+	})
+
+	dialer := &Dialer{HandshakeTimeout: 100 * time.Millisecond}
+
+	if _, err := dialer.Dial(url, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	if _, err := (&Dialer{}).DialContext(ctx, url, nil); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func Test_DialerBadScheme(t *testing.T) {
+	if _, err := NewClient("ftp://localhost/ws"); err != ErrBadScheme {
+		t.Errorf("expected %v, got %v", ErrBadScheme, err)
+	}
+}
+
+// newTLSTestServer start the websocket server behind TLS with a self-signed
+// certificate of 127.0.0.1, it return the wss url and the pool trusting the certificate
+func newTLSTestServer(t *testing.T, wsServer *Server) (string, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsListener := tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+
+	server := &fasthttp.Server{
+		Handler: wsServer.Upgrade,
+	}
+
+	go server.Serve(tlsListener)
+
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+
+	return "wss://" + ln.Addr().String() + "/ws", pool
+}
+
+func Test_DialerTLS(t *testing.T) {
+	wsServer := &Server{}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.WriteText(data)
+	})
+
+	url, pool := newTLSTestServer(t, wsServer)
+
+	// the self-signed certificate is not trusted by default
+	if _, err := NewClient(url); err == nil {
+		t.Fatal("the certificate should not be verified")
+	}
+
+	for _, config := range []*tls.Config{
+		{RootCAs: pool},
+		{InsecureSkipVerify: true},
+	} {
+		dialer := &Dialer{HandshakeTimeout: 5 * time.Second, TLSClientConfig: config}
+
+		client, err := dialer.Dial(url, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		state, ok := client.ConnectionState()
+
+		if !ok || !state.HandshakeComplete || len(state.PeerCertificates) != 1 {
+			t.Errorf("unexpected connection state %v %v", state, ok)
+		}
+
+		client.WriteText([]byte("over tls"))
+
+		if _, data, err := client.Read(); err != nil || string(data) != "over tls" {
+			t.Errorf("unexpected message %q %v", data, err)
+		}
+
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plain, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer plain.Close()
+
+	if _, ok := plain.ConnectionState(); ok {
+		t.Error("ws connection has no TLS state")
+	}
+}
+
+func Test_DialerHandshakeError(t *testing.T) {
+	body := strings.Repeat("x", handshakeErrorBodySize+100)
+
+	for _, tc := range []struct {
+		name     string
+		response string
+		status   int
+		body     string
+	}{
+		{
+			name: "content length",
+			response: "HTTP/1.1 401 Unauthorized\r\n" +
+				"WWW-Authenticate: Bearer\r\n" +
+				"Set-Cookie: session=expired; Path=/\r\n" +
+				"Content-Length: 12\r\n\r\n" +
+				"token needed",
+			status: http.StatusUnauthorized,
+			body:   "token needed",
+		},
+		{
+			name: "chunked",
+			response: "HTTP/1.1 426 Upgrade Required\r\n" +
+				"Transfer-Encoding: chunked\r\n\r\n" +
+				"6\r\nupdate\r\n7\r\n client\r\n0\r\n\r\n",
+			status: http.StatusUpgradeRequired,
+			body:   "update client",
+		},
+		{
+			name: "truncated",
+			response: "HTTP/1.1 503 Service Unavailable\r\n" +
+				"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body,
+			status: http.StatusServiceUnavailable,
+			body:   body[:handshakeErrorBodySize],
+		},
+	} {
+		response := tc.response
+
+		url := newRawTestServer(t, func(c net.Conn, req *fasthttp.Request) {
+			c.Write([]byte(response))
+		})
+
+		_, err := NewClient(url)
+
+		var handshakeErr *HandshakeError
+
+		if !errors.As(err, &handshakeErr) || !errors.Is(err, ErrCannotUpgrade) {
+			t.Fatalf("%s: expected handshake error, got %v", tc.name, err)
+		}
+
+		if handshakeErr.StatusCode != tc.status || string(handshakeErr.Body) != tc.body {
+			t.Errorf("%s: unexpected status %d body %q", tc.name, handshakeErr.StatusCode, handshakeErr.Body)
+		}
+	}
+
+	url := newRawTestServer(t, func(c net.Conn, req *fasthttp.Request) {
+		c.Write([]byte("HTTP/1.1 401 Unauthorized\r\n" +
+			"WWW-Authenticate: Bearer\r\n" +
+			"Set-Cookie: session=expired; Path=/\r\n" +
+			"Content-Length: 0\r\n\r\n"))
+	})
+
+	_, err := NewClient(url)
+
+	var handshakeErr *HandshakeError
+
+	if !errors.As(err, &handshakeErr) {
+		t.Fatalf("expected handshake error, got %v", err)
+	}
+
+	if handshakeErr.Header.Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("unexpected header %v", handshakeErr.Header)
+	}
+
+	if len(handshakeErr.Cookies) != 1 || handshakeErr.Cookies[0].Name != "session" || handshakeErr.Cookies[0].Value != "expired" {
+		t.Errorf("unexpected cookies %v", handshakeErr.Cookies)
+	}
+}
+
+func Test_DialerResponseHeader(t *testing.T) {
+	wsServer := &Server{EnableCompression: true}
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	header := client.ResponseHeader()
+
+	if header.Get("Upgrade") != "websocket" || !strings.HasPrefix(header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Errorf("unexpected response header %v", header)
+	}
+}
+
+func Test_DialerUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ws.sock")
+
+	ln, err := net.Listen("unix", socket)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make(chan string, 1)
+
+	wsServer := &Server{
+		CheckOrigin: func(ctx *fasthttp.RequestCtx) bool {
+			paths <- string(ctx.RequestURI())
+			return true
+		},
+	}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.WriteText(data)
+	})
+
+	server := &fasthttp.Server{
+		Handler: wsServer.Upgrade,
+	}
+
+	go server.Serve(ln)
+
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+
+	client, err := NewClient("ws+unix://" + socket + ":/feed?topic=prices")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path := <-paths; path != "/feed?topic=prices" {
+		t.Errorf("unexpected request uri %s", path)
+	}
+
+	client.WriteText([]byte("over unix socket"))
+
+	if _, data, err := client.Read(); err != nil || string(data) != "over unix socket" {
+		t.Errorf("unexpected message %q %v", data, err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewClient("ws+unix://localhost/ws"); err != ErrBadUnixURL {
+		t.Errorf("expected %v, got %v", ErrBadUnixURL, err)
+	}
+}
+
+func Test_DialerNetDialContext(t *testing.T) {
+	url := newTestServer(t, newEchoTestServer())
+
+	var dialed []string
+
+	dialer := &Dialer{
+		HandshakeTimeout: 5 * time.Second,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, network+" "+addr)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	client, err := dialer.Dial(url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if len(dialed) != 1 || dialed[0] != "tcp "+strings.TrimSuffix(strings.TrimPrefix(url, "ws://"), "/ws") {
+		t.Errorf("unexpected dials %v", dialed)
+	}
+}
+
+func Test_DialerCookieJarAndUserInfo(t *testing.T) {
+	requests := make(chan *fasthttp.RequestHeader, 1)
+
+	wsServer := &Server{
+		CheckOrigin: func(ctx *fasthttp.RequestCtx) bool {
+			header := &fasthttp.RequestHeader{}
+			ctx.Request.Header.CopyTo(header)
+			requests <- header
+
+			cookie := fasthttp.AcquireCookie()
+			defer fasthttp.ReleaseCookie(cookie)
+
+			cookie.SetKey("token")
+			cookie.SetValue("refreshed")
+			ctx.Response.Header.SetCookie(cookie)
+
+			return true
+		},
+	}
+
+	wsURL := newTestServer(t, wsServer)
+
+	jar, err := cookiejar.New(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse(wsURL)
+	jarURL := &url.URL{Scheme: "http", Host: u.Host, Path: "/"}
+
+	jar.SetCookies(jarURL, []*http.Cookie{{Name: "session", Value: "abc"}})
+
+	dialer := &Dialer{HandshakeTimeout: 5 * time.Second, Jar: jar}
+
+	client, err := dialer.Dial("ws://alice:secret@"+u.Host+u.Path, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	req := <-requests
+
+	if string(req.Cookie("session")) != "abc" {
+		t.Errorf("the cookie of the jar is not sent %s", req.Header())
+	}
+
+	auth := &http.Request{Header: http.Header{"Authorization": {string(req.Peek("Authorization"))}}}
+
+	if username, password, ok := auth.BasicAuth(); !ok || username != "alice" || password != "secret" {
+		t.Errorf("unexpected authorization %q", req.Peek("Authorization"))
+	}
+
+	cookies := map[string]string{}
+
+	for _, cookie := range jar.Cookies(jarURL) {
+		cookies[cookie.Name] = cookie.Value
+	}
+
+	if cookies["session"] != "abc" || cookies["token"] != "refreshed" {
+		t.Errorf("the cookie of the 101 response is not kept %v", cookies)
+	}
+
+	// the Authorization of the header wins over the user info
+	header := http.Header{}
+	header.Set("Authorization", "Bearer token")
+
+	other, err := dialer.Dial("ws://alice:secret@"+u.Host+u.Path, header)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	if req := <-requests; string(req.Peek("Authorization")) != "Bearer token" {
+		t.Errorf("unexpected authorization %q", req.Peek("Authorization"))
+	}
+}
+
+func Test_DialerSubprotocolNotOffered(t *testing.T) {
+	url := newRawTestServer(t, func(c net.Conn, req *fasthttp.Request) {
+		accept := computeAcceptKey(req.Header.PeekBytes(websocketKeyString))
+
+		c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Protocol: mqtt\r\n" +
+			"Sec-WebSocket-Accept: " + string(accept) + "\r\n\r\n"))
+	})
+
+	dialer := &Dialer{HandshakeTimeout: 5 * time.Second, Subprotocols: []string{"graphql-ws"}}
+
+	var subprotocolErr *SubprotocolError
+
+	if _, err := dialer.Dial(url, nil); !errors.As(err, &subprotocolErr) || subprotocolErr.Subprotocol != "mqtt" {
+		t.Errorf("expected subprotocol error, got %v", err)
+	}
+}
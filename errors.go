@@ -0,0 +1,170 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ProtocolError shows up when the peer breaks one of the RFC 6455 framing rules,
+// Rule describe which rule was broken
+type ProtocolError struct {
+	Rule string
+}
+
+func (e *ProtocolError) Error() string {
+	return "websocket protocol error: " + e.Rule
+}
+
+var (
+	// ErrReservedBits the RSV bits are set but no extension was negotiated
+	ErrReservedBits = &ProtocolError{Rule: "reserved bits must be zero"}
+
+	// ErrInvalidPayloadLength the most significant bit of the 64-bit payload length is set
+	ErrInvalidPayloadLength = &ProtocolError{Rule: "most significant bit of payload length must be zero"}
+
+	// ErrUnknownOpcode the opcode is one of the reserved opcodes
+	ErrUnknownOpcode = &ProtocolError{Rule: "unknown opcode"}
+
+	// ErrControlFrameTooBig the control frame payload is larger than 125 bytes
+	ErrControlFrameTooBig = &ProtocolError{Rule: "control frame payload must not exceed 125 bytes"}
+
+	// ErrFragmentedControlFrame the control frame does not set the FIN bit
+	ErrFragmentedControlFrame = &ProtocolError{Rule: "control frame must not be fragmented"}
+
+	// ErrInvalidClosePayload the close frame payload is one byte, the status code is truncated
+	ErrInvalidClosePayload = &ProtocolError{Rule: "close frame payload must be empty or at least 2 bytes"}
+
+	// ErrUnmaskedClientFrame the frame from the client is not masked
+	ErrUnmaskedClientFrame = &ProtocolError{Rule: "client frame must be masked"}
+
+	// ErrMaskedServerFrame the frame from the server is masked
+	ErrMaskedServerFrame = &ProtocolError{Rule: "server frame must not be masked"}
+
+	// ErrUnexpectedContinuation the continuation frame arrives without a fragmented message in progress
+	ErrUnexpectedContinuation = &ProtocolError{Rule: "continuation frame without a fragmented message in progress"}
+
+	// ErrInvalidCloseCode the close frame carries a status code which must not be sent on the wire
+	ErrInvalidCloseCode = &ProtocolError{Rule: "invalid close status code"}
+
+	// ErrExpectedContinuation a new data frame arrives while a fragmented message is in progress
+	ErrExpectedContinuation = &ProtocolError{Rule: "new data frame while a fragmented message is in progress"}
+)
+
+var (
+	// ErrConnClosed shows up when writing on the conn after the connection is gone
+	ErrConnClosed = errors.New("websocket: conn is closed")
+
+	// ErrMessageTooBig shows up when a frame or a message from the peer is over the read limit
+	ErrMessageTooBig = errors.New("websocket: message exceeds the read limit")
+
+	// ErrInvalidMessageType shows up when writing a message type other than text, binary, ping and pong
+	ErrInvalidMessageType = errors.New("websocket: invalid message type")
+
+	// ErrCloseSent shows up when writing or closing after the close frame was sent
+	ErrCloseSent = errors.New("websocket: close frame already sent")
+
+	// ErrCloseCodeNotAllowed shows up when the status code cannot be sent in a close frame
+	ErrCloseCodeNotAllowed = errors.New("websocket: status code cannot be sent in a close frame")
+
+	// ErrCloseReasonTooLong shows up when the close reason is longer than 123 bytes
+	ErrCloseReasonTooLong = errors.New("websocket: close reason must not exceed 123 bytes")
+)
+
+// CloseError is returned by the reads after the connection is closed, Code and
+// Text are the status code and the reason of the close frame from the peer
+type CloseError struct {
+	Code WebsocketStatusCode
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	s := "websocket: close " + strconv.Itoa(int(e.Code)) + " (" + e.Code.String() + ")"
+
+	if e.Text != "" {
+		s += ": " + e.Text
+	}
+
+	return s
+}
+
+// isFailure report the error is caused by the frames of the peer, the
+// connection is failed with the close frame of statusForError
+func isFailure(err error) bool {
+	if _, ok := err.(*ProtocolError); ok {
+		return true
+	}
+
+	return err == errInvalidUTF8 || err == errInvalidCompressedData || err == ErrMessageTooBig
+}
+
+// statusForError return the close status code used to fail the connection by the error
+func statusForError(err error) WebsocketStatusCode {
+	switch err.(type) {
+	case *ProtocolError:
+		return WebsocketStatusCodeProtocolError
+	}
+
+	switch err {
+	case errInvalidUTF8, errInvalidCompressedData:
+		return WebsocketStatusCodeInvalidFramePayloadData
+	case ErrMessageTooBig:
+		return WebsocketStatusCodeMessageTooBig
+	}
+
+	return WebsocketStatusCodeInternalServerError
+}
+
+// AcceptKeyError shows up when the Sec-WebSocket-Accept of the server does not
+// match the Sec-WebSocket-Key sent by the client
+type AcceptKeyError struct {
+	Key    string
+	Accept string
+}
+
+func (e *AcceptKeyError) Error() string {
+	return fmt.Sprintf("websocket: Sec-WebSocket-Accept %q does not match the key %q", e.Accept, e.Key)
+}
+
+// AuthorizeError is reported to the error handler of the server when Authorize refuses
+// the upgrade, StatusCode is the status of the response
+type AuthorizeError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *AuthorizeError) Error() string {
+	return fmt.Sprintf("websocket: upgrade refused with status %d: %v", e.StatusCode, e.Err)
+}
+
+func (e *AuthorizeError) Unwrap() error {
+	return e.Err
+}
+
+// SubprotocolError shows up when the server selects the subprotocol which is not offered by the client
+type SubprotocolError struct {
+	Subprotocol string
+}
+
+func (e *SubprotocolError) Error() string {
+	return fmt.Sprintf("websocket: server selected the subprotocol %q which is not offered", e.Subprotocol)
+}
+
+// HandshakeError shows up when the server answers the opening handshake without
+// 101 Switching Protocols, Body is the first 1024 bytes of the response body.
+// It matches ErrCannotUpgrade by errors.Is
+type HandshakeError struct {
+	StatusCode int
+	Header     http.Header
+	Cookies    []*http.Cookie
+	Body       []byte
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("websocket: bad handshake status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return ErrCannotUpgrade
+}
@@ -21,7 +21,7 @@ func websocketServer() {
 
 	pingHandler := func(c *websocket.Conn, data []byte) {
 		fmt.Println("receive ping from client")
-		c.Pong()
+		c.Pong(data)
 	}
 
 	wsServer.SetMessageHandler(messageHandler)
@@ -58,9 +58,14 @@ func websocketClient() {
 
 	fmt.Println(frameType, string(payload))
 
-	frameType, status := client.Close()
+	if err := client.Close(); err != nil {
+		fmt.Println("close without the close frame from server", err)
+	}
+
+	// the reads after close return the close frame from the server
+	_, _, err = client.Read()
 
-	fmt.Printf("close frameType %d status %d\n", frameType, status)
+	fmt.Println(err)
 }
 
 func main() {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"unicode/utf8"
 )
 
 var maskZeroBytes = []byte{0, 0, 0, 0}
@@ -32,7 +33,7 @@ type Frame struct {
 	rsv2        bool
 	rsv3        bool
 	mask        bool
-	frameType   frameTypeCode
+	frameType   FrameTypeCode
 	payloadSize int64
 	maskKey     []byte
 	payload     []byte
@@ -80,7 +81,7 @@ func (f *Frame) IsFin() bool {
 	return f.isFin
 }
 
-func (f *Frame) GetFrameType() frameTypeCode {
+func (f *Frame) GetFrameType() FrameTypeCode {
 	return f.frameType
 }
 
@@ -108,7 +109,7 @@ func (f *Frame) IsControl() bool {
 	return f.IsPing() || f.IsPong() || f.IsClose()
 }
 
-func (f *Frame) SetFrameType(frameType frameTypeCode) {
+func (f *Frame) SetFrameType(frameType FrameTypeCode) {
 	f.frameType = frameType
 }
 
@@ -128,10 +129,49 @@ func (f *Frame) SetFin() {
 	f.isFin = true
 }
 
-func (f *Frame) SetStatus(status websocketStatusCode) {
-	f.payload = make([]byte, 2)
+func (f *Frame) SetStatus(status WebsocketStatusCode) {
+	f.SetCloseReason(status, "")
+}
+
+// SetCloseReason set the close frame payload by the status code and the reason,
+// the payload is empty for WebsocketStatusCodeNoStatusReceived
+func (f *Frame) SetCloseReason(status WebsocketStatusCode, reason string) {
+	if status == WebsocketStatusCodeNoStatusReceived {
+		f.payload = nil
+		f.payloadSize = 0
+		return
+	}
+
+	f.payload = make([]byte, 2+len(reason))
 	binary.BigEndian.PutUint16(f.payload, uint16(status))
-	f.payloadSize = 2
+	copy(f.payload[2:], reason)
+	f.payloadSize = int64(len(f.payload))
+}
+
+// closeStatus return the status code and the reason of the close frame,
+// the status code is WebsocketStatusCodeNoStatusReceived when the payload is empty
+func (f *Frame) closeStatus() (WebsocketStatusCode, string) {
+	if len(f.payload) < 2 {
+		return WebsocketStatusCodeNoStatusReceived, ""
+	}
+
+	return WebsocketStatusCode(binary.BigEndian.Uint16(f.payload)), string(f.payload[2:])
+}
+
+// parseCloseFrame return the CloseError of the close frame from the peer, the
+// status code must be allowed on the wire and the reason must be UTF-8
+func parseCloseFrame(f *Frame, validateUTF8 bool) (*CloseError, error) {
+	code, reason := f.closeStatus()
+
+	if len(f.payload) >= 2 && !code.isValid() {
+		return nil, ErrInvalidCloseCode
+	}
+
+	if validateUTF8 && len(f.payload) > 2 && !utf8.Valid(f.payload[2:]) {
+		return nil, errInvalidUTF8
+	}
+
+	return &CloseError{Code: code, Text: reason}, nil
 }
 
 func (f *Frame) WriteTo(wr io.Writer) (int64, error) {
@@ -226,14 +266,27 @@ func (f *Frame) maskPayload() {
 }
 
 func (f *Frame) ReadFrom(r io.Reader) (int64, error) {
+	n, err := f.readHeader(r)
+
+	if err != nil {
+		return n, err
+	}
+
+	ni, err := f.readPayload(r)
+
+	return n + ni, err
+}
+
+// readHeader read the frame header, the payload size and the mask key
+func (f *Frame) readHeader(r io.Reader) (int64, error) {
 	var err error
-	var n, _ int
+	var n, ni int
 
 	header := make([]byte, 2)
 
 	n, err = io.ReadFull(r, header)
 
-	if err == io.ErrUnexpectedEOF {
+	if err != nil {
 		return int64(n), err
 	}
 
@@ -241,14 +294,15 @@ func (f *Frame) ReadFrom(r io.Reader) (int64, error) {
 	f.rsv1 = header[0]&rsv1 == rsv1
 	f.rsv2 = header[0]&rsv2 == rsv2
 	f.rsv3 = header[0]&rsv3 == rsv3
-	f.frameType = frameTypeCode(header[0] & 0x0F)
+	f.frameType = FrameTypeCode(header[0] & 0x0F)
 	f.mask = header[1]&mask == mask
 	f.payloadSize = int64(header[1] & 127)
 
 	switch f.payloadSize {
 	case 126:
 		payloadSizeBytes := make([]byte, 2)
-		n, err = io.ReadFull(r, payloadSizeBytes)
+		ni, err = io.ReadFull(r, payloadSizeBytes)
+		n += ni
 
 		if err != nil {
 			return int64(n), err
@@ -258,7 +312,8 @@ func (f *Frame) ReadFrom(r io.Reader) (int64, error) {
 
 	case 127:
 		payloadSizeBytes := make([]byte, 8)
-		n, err = io.ReadFull(r, payloadSizeBytes)
+		ni, err = io.ReadFull(r, payloadSizeBytes)
+		n += ni
 
 		if err != nil {
 			return int64(n), err
@@ -268,16 +323,22 @@ func (f *Frame) ReadFrom(r io.Reader) (int64, error) {
 	}
 
 	if f.mask {
-		n, err = io.ReadFull(r, f.maskKey)
+		ni, err = io.ReadFull(r, f.maskKey)
+		n += ni
 
 		if err != nil {
 			return int64(n), err
 		}
 	}
 
+	return int64(n), nil
+}
+
+// readPayload read the payload by the payload size of the header and unmask it
+func (f *Frame) readPayload(r io.Reader) (int64, error) {
 	f.payload = make([]byte, f.payloadSize)
 
-	n, err = io.ReadFull(r, f.payload)
+	n, err := io.ReadFull(r, f.payload)
 
 	if err != nil {
 		return int64(n), err
@@ -287,5 +348,152 @@ func (f *Frame) ReadFrom(r io.Reader) (int64, error) {
 		f.UnMask()
 	}
 
-	return int64(n), err
+	return int64(n), nil
+}
+
+// validate check the frame header follows the RFC 6455 framing rules,
+// isServer tells the frame is read by the server so it must be masked.
+// compression allows RSV1 on the first frame of a compressed message
+func (f *Frame) validate(isServer bool, compression bool) error {
+	if f.rsv2 || f.rsv3 {
+		return ErrReservedBits
+	}
+
+	if f.rsv1 && (!compression || (f.frameType != codeText && f.frameType != codeBinary)) {
+		return ErrReservedBits
+	}
+
+	// the most significant bit of the 64-bit payload length must be 0
+	if f.payloadSize < 0 {
+		return ErrInvalidPayloadLength
+	}
+
+	switch f.frameType {
+	case codeContinuation, codeText, codeBinary:
+	case codeClose, codePing, codePong:
+		if !f.isFin {
+			return ErrFragmentedControlFrame
+		}
+
+		if f.payloadSize > 125 {
+			return ErrControlFrameTooBig
+		}
+
+		if f.IsClose() && f.payloadSize == 1 {
+			return ErrInvalidClosePayload
+		}
+	default:
+		return ErrUnknownOpcode
+	}
+
+	if isServer && !f.mask {
+		return ErrUnmaskedClientFrame
+	}
+
+	if !isServer && f.mask {
+		return ErrMaskedServerFrame
+	}
+
+	return nil
+}
+
+// frameReader read the frames of a connection and check the header before the payload is read,
+// so a frame breaking the rules or over the read limit never allocates its payload
+type frameReader struct {
+	// isServer tells the frames are read by the server so they must be masked
+	isServer bool
+
+	// compression tells permessage-deflate is negotiated, the compressed message has RSV1 set
+	compression bool
+
+	// readLimit is the max size of a message, the message is not limited when it is negative
+	readLimit int64
+
+	// messageSize is the payload size of the data frames of the message in progress
+	messageSize int64
+
+	// chunkSize split the data frame bigger than it into frames of at most chunkSize,
+	// so the memory of a big frame is bounded. The frame is not split when it is zero
+	chunkSize int64
+
+	// the state of the frame being split
+	remaining int64
+	isFin     bool
+	mask      bool
+	maskKey   [4]byte
+	maskPos   int64
+}
+
+func (fr *frameReader) read(r io.Reader, f *Frame) error {
+	// the rest of the frame being split comes as continuation frames
+	if fr.remaining > 0 {
+		f.frameType = codeContinuation
+		f.rsv1, f.rsv2, f.rsv3 = false, false, false
+		f.mask = fr.mask
+
+		return fr.readChunk(r, f)
+	}
+
+	if _, err := f.readHeader(r); err != nil {
+		return err
+	}
+
+	if err := f.validate(fr.isServer, fr.compression); err != nil {
+		return err
+	}
+
+	// the limit covers every frame of a fragmented message
+	if !f.IsControl() {
+		if f.IsContinuation() {
+			fr.messageSize += f.payloadSize
+		} else {
+			fr.messageSize = f.payloadSize
+		}
+
+		if fr.readLimit >= 0 && fr.messageSize > fr.readLimit {
+			return ErrMessageTooBig
+		}
+
+		if fr.chunkSize > 0 && f.payloadSize > fr.chunkSize {
+			fr.remaining = f.payloadSize
+			fr.isFin = f.isFin
+			fr.mask = f.mask
+			fr.maskPos = 0
+			copy(fr.maskKey[:], f.maskKey)
+
+			return fr.readChunk(r, f)
+		}
+	}
+
+	_, err := f.readPayload(r)
+
+	return err
+}
+
+// readChunk read the next part of the frame being split into f
+func (fr *frameReader) readChunk(r io.Reader, f *Frame) error {
+	size := fr.remaining
+	if size > fr.chunkSize {
+		size = fr.chunkSize
+	}
+
+	f.payload = make([]byte, size)
+	f.payloadSize = size
+
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return err
+	}
+
+	fr.remaining -= size
+	f.isFin = fr.isFin && fr.remaining == 0
+
+	if fr.mask {
+		for i := range f.payload {
+			f.payload[i] ^= fr.maskKey[(fr.maskPos+int64(i))&3]
+		}
+
+		fr.maskPos += size
+	}
+
+	return nil
 }
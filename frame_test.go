@@ -0,0 +1,207 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_FrameValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		frame       Frame
+		isServer    bool
+		compression bool
+		err         error
+	}{
+		{"masked client text", Frame{isFin: true, mask: true, frameType: codeText}, true, false, nil},
+		{"unmasked server text", Frame{isFin: true, frameType: codeText}, false, false, nil},
+		{"reserved bit", Frame{isFin: true, mask: true, rsv2: true, frameType: codeText}, true, false, ErrReservedBits},
+		{"reserved opcode", Frame{isFin: true, mask: true, frameType: 0x3}, true, false, ErrUnknownOpcode},
+		{"reserved control opcode", Frame{isFin: true, mask: true, frameType: 0xB}, true, false, ErrUnknownOpcode},
+		{"control frame too big", Frame{isFin: true, mask: true, frameType: codePing, payloadSize: 126}, true, false, ErrControlFrameTooBig},
+		{"fragmented control frame", Frame{mask: true, frameType: codePong}, true, false, ErrFragmentedControlFrame},
+		{"one byte close payload", Frame{isFin: true, mask: true, frameType: codeClose, payloadSize: 1}, true, false, ErrInvalidClosePayload},
+		{"unmasked client frame", Frame{isFin: true, frameType: codeBinary}, true, false, ErrUnmaskedClientFrame},
+		{"masked server frame", Frame{isFin: true, mask: true, frameType: codeBinary}, false, false, ErrMaskedServerFrame},
+		{"rsv1 without compression", Frame{isFin: true, mask: true, rsv1: true, frameType: codeText}, true, false, ErrReservedBits},
+		{"compressed text", Frame{isFin: true, mask: true, rsv1: true, frameType: codeText}, true, true, nil},
+		{"compressed continuation", Frame{isFin: true, mask: true, rsv1: true, frameType: codeContinuation}, true, true, ErrReservedBits},
+		{"compressed ping", Frame{isFin: true, mask: true, rsv1: true, frameType: codePing}, true, true, ErrReservedBits},
+	}
+
+	for _, testCase := range testCases {
+		if err := testCase.frame.validate(testCase.isServer, testCase.compression); err != testCase.err {
+			t.Errorf("%s: expected %v, got %v", testCase.name, testCase.err, err)
+		}
+	}
+}
+
+func Test_FrameReadWrite(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		payload := bytes.Repeat([]byte("a"), size)
+
+		frame := newFrame()
+		frame.SetFin()
+		frame.SetFrameType(codeBinary)
+		frame.SetPayload(append([]byte(nil), payload...))
+		frame.SetPayloadSize(int64(size))
+		frame.SetMask()
+
+		buffer := bytes.Buffer{}
+
+		if _, err := frame.WriteTo(&buffer); err != nil {
+			t.Fatal(err)
+		}
+
+		readFrame := newFrame()
+
+		if _, err := readFrame.ReadFrom(&buffer); err != nil {
+			t.Fatal(err)
+		}
+
+		if !readFrame.IsFin() || readFrame.GetFrameType() != codeBinary || !bytes.Equal(readFrame.GetPayload(), payload) {
+			t.Errorf("size %d: unexpected frame %v", size, readFrame)
+		}
+	}
+}
+
+func Test_ServerCloseProtocolError(t *testing.T) {
+	wsServer := &Server{}
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client frame without mask breaks the protocol
+	frame := newFrame()
+	frame.SetFin()
+	frame.SetFrameType(codeText)
+	frame.SetPayload([]byte("unmasked"))
+	frame.SetPayloadSize(8)
+	frame.WriteTo(client.rwBuffer)
+	client.rwBuffer.Flush()
+
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err = client.Read()
+
+	closeErr, ok := err.(*CloseError)
+
+	if !ok {
+		t.Fatalf("expected close error, got %v", err)
+	}
+
+	if closeErr.Code != WebsocketStatusCodeProtocolError {
+		t.Errorf("expected status %v, got %v", WebsocketStatusCodeProtocolError, closeErr.Code)
+	}
+}
+
+func Test_FrameReaderReadLimit(t *testing.T) {
+	testCases := []struct {
+		name   string
+		header []byte
+		err    error
+	}{
+		{"frame over the limit", []byte{0x82, 0x7f, 0x40, 0, 0, 0, 0, 0, 0, 0}, ErrMessageTooBig},
+		{"negative payload length", []byte{0x82, 0x7f, 0x80, 0, 0, 0, 0, 0, 0, 0}, ErrInvalidPayloadLength},
+	}
+
+	for _, testCase := range testCases {
+		reader := frameReader{readLimit: 1024}
+
+		if err := reader.read(bytes.NewReader(testCase.header), newFrame()); err != testCase.err {
+			t.Errorf("%s: expected %v, got %v", testCase.name, testCase.err, err)
+		}
+	}
+}
+
+func Test_ServerReadLimit(t *testing.T) {
+	testCases := map[string][][]byte{
+		"single frame":     {[]byte("hello websocket")},
+		"fragmented frame": {[]byte("hello "), []byte("websocket")},
+	}
+
+	for name, fragments := range testCases {
+		wsServer := &Server{
+			ReadLimit: 10,
+		}
+
+		wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+			t.Errorf("%s: message over the limit should not reach the handler: %q", name, data)
+		})
+
+		client, err := NewClient(newTestServer(t, wsServer))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, fragment := range fragments {
+			frameType := codeText
+			if i > 0 {
+				frameType = codeContinuation
+			}
+
+			writeTestFrame(t, client, frameType, i == len(fragments)-1, fragment)
+		}
+
+		client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		_, _, err = client.Read()
+
+		if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != WebsocketStatusCodeMessageTooBig {
+			t.Errorf("%s: expected message too big close, got %v", name, err)
+		}
+	}
+}
+
+func Test_ClientReadLimit(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+
+	client := NewClientConn(clientSide)
+	client.ReadLimit = 1024
+
+	closeCodes := make(chan WebsocketStatusCode, 1)
+
+	go func() {
+		// only the header of a 1 GB frame is sent, the client must not wait the payload
+		serverSide.Write([]byte{0x82, 0x7f, 0, 0, 0, 0, 0x40, 0, 0, 0})
+
+		frame := newFrame()
+		reader := frameReader{isServer: true, readLimit: -1}
+
+		if err := reader.read(bufio.NewReader(serverSide), frame); err != nil || !frame.IsClose() {
+			closeCodes <- 0
+			return
+		}
+
+		closeErr, _ := parseCloseFrame(frame, true)
+		closeCodes <- closeErr.Code
+	}()
+
+	clientSide.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, _, err := client.Read(); err != ErrMessageTooBig {
+		t.Errorf("expected %v, got %v", ErrMessageTooBig, err)
+	}
+
+	select {
+	case code := <-closeCodes:
+		if code != WebsocketStatusCodeMessageTooBig {
+			t.Errorf("expected the close frame %v, got %v", WebsocketStatusCodeMessageTooBig, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client did not send the close frame")
+	}
+
+	if _, _, err := client.Read(); !errors.As(err, new(*CloseError)) {
+		t.Errorf("expected close error, got %v", err)
+	}
+}
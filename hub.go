@@ -0,0 +1,139 @@
+package websocket
+
+import (
+	"sync"
+)
+
+// Hub is the registry of the open connections of the Server, the conn is added when it
+// is upgraded and removed when it ends. It is safe for concurrent use
+type Hub struct {
+	mutex sync.RWMutex
+	conns map[uint64]*Conn
+}
+
+// register add the conn to the hub
+func (h *Hub) register(c *Conn) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.conns == nil {
+		h.conns = make(map[uint64]*Conn)
+	}
+
+	h.conns[c.ID()] = c
+}
+
+// unregister remove the conn from the hub
+func (h *Hub) unregister(c *Conn) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.conns, c.ID())
+}
+
+// Get return the conn of the ID, ok is false when the conn is not open
+func (h *Hub) Get(id uint64) (c *Conn, ok bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	c, ok = h.conns[id]
+
+	return c, ok
+}
+
+// Count return the number of the open conns
+func (h *Hub) Count() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return len(h.conns)
+}
+
+// Range call f for every open conn until f returns false, the conns opened or closed
+// during Range may be missed. f can write on the conn and use the hub
+func (h *Hub) Range(f func(c *Conn) bool) {
+	for _, c := range h.snapshot() {
+		if !f(c) {
+			return
+		}
+	}
+}
+
+// Broadcast queue the message on every open conn without waiting, the conn writes it
+// after the messages in progress. The conn closing and the conn whose broadcast queue
+// is full are skipped, one slow client never holds the others. It return the number
+// of the conns the message is queued on
+func (h *Hub) Broadcast(messageType FrameTypeCode, data []byte) int {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return 0
+	}
+
+	if checkMessage(messageType, data) != nil {
+		return 0
+	}
+
+	// the conns share the copy, the caller can reuse data after return
+	message := bufferedMessage{
+		messageType: messageType,
+		data:        append([]byte(nil), data...),
+	}
+
+	sent := 0
+
+	for _, c := range h.snapshot() {
+		if c.closing() {
+			continue
+		}
+
+		if c.queueBroadcast(message) {
+			sent++
+		}
+	}
+
+	return sent
+}
+
+// snapshot return the open conns, the lock is not held while the conns are used
+func (h *Hub) snapshot() []*Conn {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	conns := make([]*Conn, 0, len(h.conns))
+
+	for _, c := range h.conns {
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+// startBroadcasts let the conn take the messages of Hub.Broadcast until it ends
+func (c *Conn) startBroadcasts() {
+	c.broadcasts = make(chan bufferedMessage, cap(c.WriteChan))
+
+	go c.broadcastLoop()
+}
+
+// broadcastLoop write the broadcast messages in order, the write waits the message
+// from NextWriter and the full write queue like WriteMessage does
+func (c *Conn) broadcastLoop() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case message := <-c.broadcasts:
+			// the message is dropped once the conn is closing
+			c.WriteMessage(message.messageType, message.data)
+		}
+	}
+}
+
+// queueBroadcast queue the message without waiting, it report false when the queue is full
+func (c *Conn) queueBroadcast(message bufferedMessage) bool {
+	select {
+	case c.broadcasts <- message:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,349 @@
+package websocket
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Hub(t *testing.T) {
+	hub := &Hub{}
+	opened := make(chan uint64, 8)
+
+	wsServer := &Server{Hub: hub}
+
+	wsServer.OnOpen(func(c *Conn) {
+		// the conn is registered before OnOpen
+		if _, ok := hub.Get(c.ID()); !ok {
+			t.Error("the conn is not registered")
+		}
+
+		opened <- c.ID()
+	})
+
+	url := newTestServer(t, wsServer)
+
+	const clients = 4
+
+	received := make(chan string, clients*2)
+
+	var started []*Client
+	ids := map[uint64]bool{}
+
+	for i := 0; i < clients; i++ {
+		client, err := NewClient(url)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+			received <- string(data)
+		})
+
+		client.Start()
+		started = append(started, client)
+
+		ids[<-opened] = true
+	}
+
+	if len(ids) != clients || hub.Count() != clients {
+		t.Fatalf("expected %d unique conns, got %d ids and %d conns", clients, len(ids), hub.Count())
+	}
+
+	ranged := 0
+
+	hub.Range(func(c *Conn) bool {
+		if !ids[c.ID()] {
+			t.Errorf("unknown conn %d", c.ID())
+		}
+
+		ranged++
+
+		return true
+	})
+
+	if ranged != clients {
+		t.Errorf("expected %d conns in Range, got %d", clients, ranged)
+	}
+
+	// the conn is removed once it ends
+	started[0].Close()
+
+	waitCount := func(expected int) {
+		t.Helper()
+
+		for deadline := time.Now().Add(5 * time.Second); hub.Count() != expected; {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d conns, got %d", expected, hub.Count())
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitCount(clients - 1)
+
+	// the client which never answers the close frame keeps its conn closing
+	silent, err := NewClient(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.c.Close()
+
+	silentID := <-opened
+	waitCount(clients)
+
+	conn, _ := hub.Get(silentID)
+	conn.Close()
+
+	if sent := hub.Broadcast(TextMessage, []byte("news")); sent != clients-1 {
+		t.Errorf("expected the broadcast to %d conns, got %d", clients-1, sent)
+	}
+
+	for i := 0; i < clients-1; i++ {
+		select {
+		case data := <-received:
+			if data != "news" {
+				t.Errorf("unexpected message %q", data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the broadcast did not arrive")
+		}
+	}
+
+	for _, client := range started[1:] {
+		client.Close()
+	}
+}
+
+func Test_HubConcurrent(t *testing.T) {
+	hub := &Hub{}
+
+	wsServer := &Server{Hub: hub}
+
+	url := newTestServer(t, wsServer)
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			client, err := NewClient(url)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			client.Close()
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			hub.Broadcast(TextMessage, []byte("hello"))
+			hub.Range(func(c *Conn) bool {
+				hub.Get(c.ID())
+				return true
+			})
+		}()
+	}
+
+	wg.Wait()
+
+	for deadline := time.Now().Add(5 * time.Second); hub.Count() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no conn, got %d", hub.Count())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_HubBroadcastStalledConn(t *testing.T) {
+	hub := &Hub{}
+	opened := make(chan *Conn, 2)
+
+	wsServer := &Server{Hub: hub, WriteQueueSize: 2}
+
+	wsServer.OnOpen(func(c *Conn) {
+		opened <- c
+	})
+
+	received := make(chan string, 4)
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	client.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		received <- string(data)
+	})
+
+	client.Start()
+
+	<-opened
+
+	// the stalled client never reads the pipe
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	go wsServer.ServeConn(serverSide)
+
+	stalled := <-opened
+
+	go func() {
+		for stalled.WriteText([]byte("hello")) == nil {
+		}
+	}()
+
+	for len(stalled.WriteChan) < cap(stalled.WriteChan) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the broadcast queue of the stalled conn fills up, then only the live conn gets the message
+	for i := 0; ; i++ {
+		if i == 16 {
+			t.Fatal("the stalled conn never skipped the broadcast")
+		}
+
+		done := make(chan int, 1)
+
+		go func() {
+			done <- hub.Broadcast(TextMessage, []byte("news"))
+		}()
+
+		var sent int
+
+		select {
+		case sent = <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stalled conn blocked the broadcast")
+		}
+
+		if sent == 0 {
+			t.Fatal("the live conn skipped the broadcast")
+		}
+
+		select {
+		case data := <-received:
+			if data != "news" {
+				t.Errorf("unexpected message %q", data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the broadcast did not arrive")
+		}
+
+		if sent == 1 {
+			break
+		}
+	}
+}
+
+func Test_HubBroadcastConcurrentWriter(t *testing.T) {
+	hub := &Hub{}
+	opened := make(chan *Conn, 1)
+
+	wsServer := &Server{Hub: hub}
+
+	wsServer.OnOpen(func(c *Conn) {
+		opened <- c
+	})
+
+	received := make(chan string, 1024)
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	client.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		if string(data) == "news" || string(data) == "streamed" {
+			received <- string(data)
+		}
+	})
+
+	client.Start()
+
+	conn := <-opened
+
+	// the message in progress holds the broadcast until the writer closes
+	writer, err := conn.NextWriter(TextMessage)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer.Write([]byte("stream"))
+
+	if sent := hub.Broadcast(TextMessage, []byte("news")); sent != 1 {
+		t.Errorf("expected the broadcast during NextWriter to 1 conn, got %d", sent)
+	}
+
+	writer.Write([]byte("ed"))
+	writer.Close()
+
+	for _, expected := range []string{"streamed", "news"} {
+		select {
+		case data := <-received:
+			if data != expected {
+				t.Errorf("expected %q, got %q", expected, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q did not arrive", expected)
+		}
+	}
+
+	// the concurrent writer holds the message lock most of the time
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				conn.WriteText([]byte("other"))
+			}
+		}
+	}()
+
+	const broadcasts = 100
+
+	for i := 0; i < broadcasts; i++ {
+		if sent := hub.Broadcast(TextMessage, []byte("news")); sent != 1 {
+			t.Fatalf("broadcast %d: expected 1 conn, got %d", i, sent)
+		}
+	}
+
+	close(stop)
+	<-stopped
+
+	for i := 0; i < broadcasts; i++ {
+		select {
+		case data := <-received:
+			if data != "news" {
+				t.Errorf("unexpected message %q", data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d broadcasts arrived", i, broadcasts)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package websocket
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_ServerAutoPong(t *testing.T) {
+	wsServer := &Server{}
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if err := client.WriteMessage(PingMessage, []byte("are you there")); err != nil {
+		t.Fatal(err)
+	}
+
+	messageType, payload, err := client.Read()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messageType != PongMessage || string(payload) != "are you there" {
+		t.Errorf("expected pong with the ping payload, got %v %q", messageType, payload)
+	}
+}
+
+func Test_ServerKeepalive(t *testing.T) {
+	wsServer := &Server{
+		PingInterval: 50 * time.Millisecond,
+		CloseTimeout: 100 * time.Millisecond,
+	}
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// the client answers the pings by itself and stays connected
+	for i := 0; i < 3; i++ {
+		messageType, _, err := client.Read()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if messageType != PingMessage {
+			t.Fatalf("expected ping, got %v", messageType)
+		}
+	}
+
+	// the client stop answering the pings
+	frame := newFrame()
+	reader := frameReader{readLimit: -1}
+
+	for {
+		if err := reader.read(client.rwBuffer, frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if !frame.IsClose() {
+			continue
+		}
+
+		closeErr, _ := parseCloseFrame(frame, true)
+
+		if closeErr == nil || closeErr.Code != WebsocketStatusCodeGoingAway {
+			t.Errorf("expected going away close, got %v", closeErr)
+		}
+
+		break
+	}
+}
+
+func Test_ServerKeepaliveWriteQueueFull(t *testing.T) {
+	wsServer := &Server{
+		PingInterval:   50 * time.Millisecond,
+		CloseTimeout:   200 * time.Millisecond,
+		WriteQueueSize: 2,
+	}
+
+	opened := make(chan *Conn, 1)
+	closed := make(chan struct{})
+
+	wsServer.OnOpen(func(c *Conn) {
+		opened <- c
+	})
+
+	wsServer.OnClose(func(c *Conn, code WebsocketStatusCode, reason string) {
+		close(closed)
+	})
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	go wsServer.ServeConn(serverSide)
+
+	conn := <-opened
+
+	// the client never reads, the writes keep the queue full
+	go func() {
+		for conn.WriteText([]byte("hello")) == nil {
+		}
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the half dead connection was not closed")
+	}
+}
+
+func Test_ClientAutoPong(t *testing.T) {
+	wsServer := &Server{}
+	pongs := make(chan string, 1)
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.WriteMessage(PingMessage, data)
+	})
+
+	wsServer.SetPongHandler(func(c *Conn, data []byte) {
+		pongs <- string(data)
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	client.WriteText([]byte("are you there"))
+
+	if messageType, _, err := client.Read(); err != nil || messageType != PingMessage {
+		t.Fatalf("expected ping, got %v %v", messageType, err)
+	}
+
+	select {
+	case data := <-pongs:
+		if data != "are you there" {
+			t.Errorf("expected pong with the ping payload, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client did not answer the ping")
+	}
+}
@@ -0,0 +1,69 @@
+package websocket
+
+import (
+	"sync"
+)
+
+// Locals is the store of the values attached to the connection like the user or the
+// tenant, it is safe for concurrent use. The user values of the fasthttp.RequestCtx
+// are copied into it on the upgrade
+type Locals struct {
+	mutex  sync.RWMutex
+	values map[interface{}]interface{}
+}
+
+// Set attach the value to the key
+func (l *Locals) Set(key, value interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.values == nil {
+		l.values = make(map[interface{}]interface{})
+	}
+
+	l.values[key] = value
+}
+
+// Get return the value of the key, ok is false when the key has no value
+func (l *Locals) Get(key interface{}) (value interface{}, ok bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	value, ok = l.values[key]
+
+	return value, ok
+}
+
+// Delete remove the value of the key
+func (l *Locals) Delete(key interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.values, key)
+}
+
+// Range call f for every key and value until f returns false, f must not change the Locals
+func (l *Locals) Range(f func(key, value interface{}) bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	for key, value := range l.values {
+		if !f(key, value) {
+			return
+		}
+	}
+}
+
+// LocalValue return the value of the key as T, ok is false when the key has no value
+// or the value is not a T
+func LocalValue[T any](l *Locals, key interface{}) (value T, ok bool) {
+	v, found := l.Get(key)
+
+	if !found {
+		return value, false
+	}
+
+	value, ok = v.(T)
+
+	return value, ok
+}
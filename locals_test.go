@@ -0,0 +1,58 @@
+package websocket
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func Test_Locals(t *testing.T) {
+	locals := &Locals{}
+
+	if _, ok := locals.Get("user"); ok {
+		t.Error("the empty locals has no value")
+	}
+
+	locals.Set("user", 42)
+
+	if user, ok := LocalValue[int](locals, "user"); !ok || user != 42 {
+		t.Errorf("unexpected user %d %v", user, ok)
+	}
+
+	// the value of another type is not returned
+	if _, ok := LocalValue[string](locals, "user"); ok {
+		t.Error("the int value is not a string")
+	}
+
+	locals.Delete("user")
+
+	if _, ok := LocalValue[int](locals, "user"); ok {
+		t.Error("the value should be deleted")
+	}
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			locals.Set(strconv.Itoa(i), i)
+			locals.Get(strconv.Itoa(i))
+		}(i)
+	}
+
+	wg.Wait()
+
+	count := 0
+
+	locals.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+
+	if count != 10 {
+		t.Errorf("expected 10 values, got %d", count)
+	}
+}
@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+var errInvalidUTF8 = errors.New("text message is not valid UTF-8")
+
+// checkMessage check the message can be written in a single frame by WriteMessage
+func checkMessage(messageType FrameTypeCode, data []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage:
+	case PingMessage, PongMessage:
+		if len(data) > 125 {
+			return ErrControlFrameTooBig
+		}
+	default:
+		return ErrInvalidMessageType
+	}
+
+	return nil
+}
+
+// messageBuffer reassembles a fragmented message, it keeps the opcode of the
+// first frame and appends the continuation frames payload until the FIN frame
+type messageBuffer struct {
+	frameType  FrameTypeCode
+	payload    []byte
+	fragmented bool
+
+	// validateUTF8 check the text message frame by frame when it is set
+	validateUTF8 bool
+	utf8         utf8Validator
+
+	// compressed tells the message in progress is compressed, it is inflated by the
+	// decompressor when it is complete and the output is limited by readLimit
+	compressed   bool
+	decompressor *decompressor
+	readLimit    int64
+}
+
+// push add the data frame to the message and report the message is complete or not
+func (m *messageBuffer) push(f *Frame) (bool, error) {
+	if f.IsContinuation() {
+		if !m.fragmented {
+			return false, ErrUnexpectedContinuation
+		}
+
+		m.payload = append(m.payload, f.payload...)
+	} else {
+		if m.fragmented {
+			return false, ErrExpectedContinuation
+		}
+
+		m.frameType = f.frameType
+		m.payload = append(m.payload[:0], f.payload...)
+		m.compressed = f.rsv1
+	}
+
+	m.fragmented = !f.isFin
+
+	// the compressed text is validated after it is inflated
+	if m.validateUTF8 && m.frameType == codeText && !m.compressed {
+		if !m.utf8.write(f.payload) || (f.isFin && !m.utf8.done()) {
+			return false, errInvalidUTF8
+		}
+	}
+
+	if f.isFin && m.compressed {
+		return true, m.inflate()
+	}
+
+	return f.isFin, nil
+}
+
+// inflate replace the compressed payload of the complete message by the inflated one
+func (m *messageBuffer) inflate() error {
+	payload, err := m.decompressor.decompress(m.payload, m.readLimit)
+
+	if err != nil {
+		return err
+	}
+
+	if m.validateUTF8 && m.frameType == codeText && !utf8.Valid(payload) {
+		return errInvalidUTF8
+	}
+
+	m.payload = payload
+
+	return nil
+}
+
+// take return the complete message, the payload is owned by the caller
+func (m *messageBuffer) take() (FrameTypeCode, []byte) {
+	frameType, payload := m.frameType, m.payload
+
+	m.reset()
+
+	return frameType, payload
+}
+
+func (m *messageBuffer) reset() {
+	m.frameType = codeUnknown
+	m.payload = nil
+	m.fragmented = false
+	m.compressed = false
+	m.utf8.reset()
+}
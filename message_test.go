@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_MessageBufferReassemble(t *testing.T) {
+	m := messageBuffer{}
+
+	frames := []*Frame{
+		{frameType: codeBinary, payload: []byte("hello ")},
+		{frameType: codeContinuation, payload: []byte("websocket ")},
+		{frameType: codeContinuation, isFin: true, payload: []byte("world")},
+	}
+
+	for i, f := range frames {
+		complete, err := m.push(f)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if complete != (i == len(frames)-1) {
+			t.Fatalf("frame %d complete should be %v", i, !complete)
+		}
+	}
+
+	frameType, payload := m.take()
+
+	if frameType != codeBinary {
+		t.Errorf("expected frame type %v, got %v", codeBinary, frameType)
+	}
+
+	if !bytes.Equal(payload, []byte("hello websocket world")) {
+		t.Errorf("unexpected payload %q", payload)
+	}
+}
+
+func Test_MessageBufferInvalidSequence(t *testing.T) {
+	m := messageBuffer{}
+
+	if _, err := m.push(&Frame{frameType: codeContinuation, isFin: true}); err != ErrUnexpectedContinuation {
+		t.Errorf("expected %v, got %v", ErrUnexpectedContinuation, err)
+	}
+
+	if _, err := m.push(&Frame{frameType: codeText}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.push(&Frame{frameType: codeText, isFin: true}); err != ErrExpectedContinuation {
+		t.Errorf("expected %v, got %v", ErrExpectedContinuation, err)
+	}
+}
+
+func Test_ServerReassembleFragmentedMessage(t *testing.T) {
+	wsServer := &Server{}
+
+	received := make(chan []byte, 1)
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		if isBinary {
+			t.Error("fragmented text message should not be binary")
+		}
+
+		received <- append([]byte(nil), data...)
+	})
+
+	wsServer.SetPingHandler(func(c *Conn, data []byte) {
+		c.Pong(data)
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFrame(t, client, codeText, false, []byte("frag"))
+	writeTestFrame(t, client, codePing, true, nil)
+	writeTestFrame(t, client, codeContinuation, false, []byte("ment"))
+	writeTestFrame(t, client, codeContinuation, true, []byte("ed"))
+
+	// the ping in the middle of the message is answered before the message completes
+	frameType, _, err := client.Read()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frameType != codePong {
+		t.Errorf("expected pong, got %v", frameType)
+	}
+
+	if data := <-received; string(data) != "fragmented" {
+		t.Errorf("unexpected message %q", data)
+	}
+}
+
+func Test_WriteMessageTypes(t *testing.T) {
+	wsServer := &Server{}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		if isBinary {
+			c.WriteBinary(data)
+		} else {
+			c.WriteText(data)
+		}
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary := []byte{0x00, 0xff, 0xfe, 0x01}
+
+	if err := client.WriteBinary(binary); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(binary, []byte{0x00, 0xff, 0xfe, 0x01}) {
+		t.Errorf("the written data should not be masked in place: %v", binary)
+	}
+
+	messageType, payload, err := client.Read()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messageType != BinaryMessage || !bytes.Equal(payload, binary) {
+		t.Errorf("unexpected message %v %v", messageType, payload)
+	}
+
+	if err := client.WriteMessage(TextMessage, []byte("text")); err != nil {
+		t.Fatal(err)
+	}
+
+	if messageType, payload, err = client.Read(); err != nil || messageType != TextMessage || string(payload) != "text" {
+		t.Errorf("unexpected message %v %q %v", messageType, payload, err)
+	}
+
+	if err := client.WriteMessage(codeContinuation, nil); err != ErrInvalidMessageType {
+		t.Errorf("expected %v, got %v", ErrInvalidMessageType, err)
+	}
+
+	if err := client.WriteMessage(PingMessage, make([]byte, 126)); err != ErrControlFrameTooBig {
+		t.Errorf("expected %v, got %v", ErrControlFrameTooBig, err)
+	}
+}
@@ -0,0 +1,364 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	// ErrUnsupportedProxy shows up when the proxy url scheme is not http, https, socks5 or socks5h
+	ErrUnsupportedProxy = errors.New("websocket: proxy scheme must be http, https, socks5 or socks5h")
+
+	connectString            = []byte("CONNECT")
+	proxyAuthorizationString = []byte("Proxy-Authorization")
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+
+	socks5CommandConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+// ProxyError shows up when the proxy refuses to open the tunnel to the server
+type ProxyError struct {
+	Proxy  string
+	Reason string
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("websocket: proxy %s: %s", e.Proxy, e.Reason)
+}
+
+// proxyURL return the proxy of the websocket url by the Proxy of the Dialer, the
+// ws url is asked as http and the wss url as https like the environment variables expect
+func (d *Dialer) proxyURL(u *url.URL) (*url.URL, error) {
+	if d.Proxy == nil {
+		return nil, nil
+	}
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    httpURL(u),
+		Header: http.Header{},
+		Host:   u.Host,
+	}
+
+	return d.Proxy(req)
+}
+
+// proxyAddr return the address of the proxy with the default port of its scheme
+func proxyAddr(proxy *url.URL) (string, error) {
+	port := proxy.Port()
+
+	switch proxy.Scheme {
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+	case "socks5", "socks5h":
+		if port == "" {
+			port = "1080"
+		}
+	default:
+		return "", ErrUnsupportedProxy
+	}
+
+	return net.JoinHostPort(proxy.Hostname(), port), nil
+}
+
+// connectProxy open the tunnel to the address through the proxy connected by c
+func connectProxy(ctx context.Context, c net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	switch proxy.Scheme {
+	case "https":
+		tlsConn := tls.Client(c, &tls.Config{ServerName: proxy.Hostname()})
+
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+
+		return httpConnect(tlsConn, proxy, addr)
+	case "http":
+		return httpConnect(c, proxy, addr)
+	case "socks5":
+		// socks5h sends the host name to the proxy, socks5 resolves it locally
+		resolved, err := resolveAddr(ctx, addr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return c, socks5Connect(c, proxy, resolved)
+	default:
+		return c, socks5Connect(c, proxy, addr)
+	}
+}
+
+// resolveAddr return the address with the host name resolved to an IP, the IPv4 comes first
+func resolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(ips) == 0 {
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	ip := ips[0].IP
+
+	for _, candidate := range ips {
+		if candidate.IP.To4() != nil {
+			ip = candidate.IP
+			break
+		}
+	}
+
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// httpConnect ask the HTTP proxy to open the tunnel by CONNECT, the user info of
+// the proxy url is sent as the Basic proxy authorization
+func httpConnect(c net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethodBytes(connectString)
+	req.Header.SetRequestURI(addr)
+	req.Header.SetHost(addr)
+
+	if proxy.User != nil {
+		req.Header.SetBytesK(proxyAuthorizationString, basicAuth(proxy.User))
+	}
+
+	bw := bufio.NewWriter(c)
+
+	if err := req.Write(bw); err != nil {
+		return nil, err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	// the response of CONNECT has no body, the tunnel starts right after the header
+	br := bufio.NewReader(c)
+	resp.SkipBody = true
+
+	if err := resp.Read(br); err != nil {
+		return nil, err
+	}
+
+	// any 2xx status opens the tunnel
+	if resp.StatusCode() < 200 || resp.StatusCode() > 299 {
+		return nil, &ProxyError{Proxy: proxy.Host, Reason: "CONNECT status " + strconv.Itoa(resp.StatusCode())}
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, reader: br}, nil
+	}
+
+	return c, nil
+}
+
+// bufferedConn read the data buffered after the response of the proxy first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// socks5Connect ask the SOCKS5 proxy to open the tunnel by RFC 1928, the user info
+// of the proxy url is the username and password authentication of RFC 1929
+func socks5Connect(c net.Conn, proxy *url.URL, addr string) error {
+	host, portString, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+
+	if err != nil {
+		return err
+	}
+
+	method := byte(socks5AuthNone)
+
+	if proxy.User != nil {
+		method = socks5AuthPassword
+	}
+
+	if _, err := c.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != socks5Version {
+		return &ProxyError{Proxy: proxy.Host, Reason: "not a SOCKS5 proxy"}
+	}
+
+	if reply[1] != method {
+		return &ProxyError{Proxy: proxy.Host, Reason: "no acceptable authentication method"}
+	}
+
+	if method == socks5AuthPassword {
+		if err := socks5Authenticate(c, proxy); err != nil {
+			return err
+		}
+	}
+
+	req := []byte{socks5Version, socks5CommandConnect, 0}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return &ProxyError{Proxy: proxy.Host, Reason: "host name too long"}
+		}
+
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	// the reply is the version, the status, the reserved byte and the bound address
+	header := make([]byte, 4)
+
+	if _, err := io.ReadFull(c, header); err != nil {
+		return err
+	}
+
+	if header[1] != 0 {
+		return &ProxyError{Proxy: proxy.Host, Reason: socks5Status(header[1])}
+	}
+
+	var size int
+
+	switch header[3] {
+	case socks5AddrIPv4:
+		size = net.IPv4len
+	case socks5AddrIPv6:
+		size = net.IPv6len
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+
+		if _, err := io.ReadFull(c, length); err != nil {
+			return err
+		}
+
+		size = int(length[0])
+	default:
+		return &ProxyError{Proxy: proxy.Host, Reason: "invalid bound address type"}
+	}
+
+	// the bound address and port are not used
+	_, err = io.ReadFull(c, make([]byte, size+2))
+
+	return err
+}
+
+// socks5Authenticate send the username and the password of the proxy url
+func socks5Authenticate(c net.Conn, proxy *url.URL) error {
+	username := proxy.User.Username()
+	password, _ := proxy.User.Password()
+
+	if len(username) > 255 || len(password) > 255 {
+		return &ProxyError{Proxy: proxy.Host, Reason: "username or password too long"}
+	}
+
+	req := []byte{1, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+
+	if reply[1] != 0 {
+		return &ProxyError{Proxy: proxy.Host, Reason: "authentication failed"}
+	}
+
+	return nil
+}
+
+func socks5Status(status byte) string {
+	switch status {
+	case 0x01:
+		return "general SOCKS server failure"
+	case 0x02:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	}
+
+	return "unknown SOCKS5 status " + strconv.Itoa(int(status))
+}
@@ -0,0 +1,352 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveTestProxy accept the connections of the proxy stand-in on a random local port,
+// connect open the tunnel and return the target address, it return the proxy address
+func serveTestProxy(t *testing.T, connect func(c net.Conn, br *bufio.Reader) (string, bool)) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				br := bufio.NewReader(c)
+
+				addr, ok := connect(c, br)
+
+				if !ok {
+					return
+				}
+
+				target, err := net.Dial("tcp", addr)
+
+				if err != nil {
+					return
+				}
+
+				defer target.Close()
+
+				go io.Copy(target, br)
+				io.Copy(c, target)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// newHTTPTestProxy start an HTTP CONNECT proxy requiring the Basic proxy auth of the user
+func newHTTPTestProxy(t *testing.T, user *url.Userinfo) *url.URL {
+	addr := serveTestProxy(t, func(c net.Conn, br *bufio.Reader) (string, bool) {
+		req, err := http.ReadRequest(br)
+
+		if err != nil || req.Method != http.MethodConnect {
+			return "", false
+		}
+
+		password, _ := user.Password()
+		auth := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+
+		if username, pass, ok := auth.BasicAuth(); !ok || username != user.Username() || pass != password {
+			c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+			return "", false
+		}
+
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		return req.Host, true
+	})
+
+	return &url.URL{Scheme: "http", Host: addr, User: user}
+}
+
+// newSOCKS5TestProxy start a SOCKS5 proxy requiring the username and password of the user,
+// the requested hosts are sent to hosts when it is not nil
+func newSOCKS5TestProxy(t *testing.T, user *url.Userinfo, hosts chan<- string) *url.URL {
+	addr := serveTestProxy(t, func(c net.Conn, br *bufio.Reader) (string, bool) {
+		greeting := make([]byte, 2)
+
+		if _, err := io.ReadFull(br, greeting); err != nil || greeting[0] != socks5Version {
+			return "", false
+		}
+
+		methods := make([]byte, greeting[1])
+		io.ReadFull(br, methods)
+
+		c.Write([]byte{socks5Version, socks5AuthPassword})
+
+		// RFC 1929 username and password
+		header := make([]byte, 2)
+		io.ReadFull(br, header)
+		username := make([]byte, header[1])
+		io.ReadFull(br, username)
+		length, _ := br.ReadByte()
+		password := make([]byte, length)
+		io.ReadFull(br, password)
+
+		expected, _ := user.Password()
+
+		if string(username) != user.Username() || string(password) != expected {
+			c.Write([]byte{1, 1})
+			return "", false
+		}
+
+		c.Write([]byte{1, 0})
+
+		req := make([]byte, 4)
+
+		if _, err := io.ReadFull(br, req); err != nil || req[1] != socks5CommandConnect {
+			return "", false
+		}
+
+		var host string
+
+		switch req[3] {
+		case socks5AddrIPv4:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case socks5AddrDomain:
+			length, _ := br.ReadByte()
+			domain := make([]byte, length)
+			io.ReadFull(br, domain)
+			host = string(domain)
+		default:
+			c.Write([]byte{socks5Version, 0x08, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+			return "", false
+		}
+
+		port := make([]byte, 2)
+		io.ReadFull(br, port)
+
+		if hosts != nil {
+			hosts <- host
+		}
+
+		c.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+
+		return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), true
+	})
+
+	return &url.URL{Scheme: "socks5", Host: addr, User: user}
+}
+
+// testDialThroughProxy dial the url through the proxy and echo a message
+func testDialThroughProxy(t *testing.T, rawURL string, proxy *url.URL) {
+	t.Helper()
+
+	dialer := &Dialer{
+		HandshakeTimeout: 5 * time.Second,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: true},
+		Proxy:            http.ProxyURL(proxy),
+	}
+
+	client, err := dialer.Dial(rawURL, nil)
+
+	if err != nil {
+		t.Fatalf("%s through %s: %v", rawURL, proxy.Scheme, err)
+	}
+
+	client.WriteText([]byte("through the proxy"))
+
+	if _, data, err := client.Read(); err != nil || string(data) != "through the proxy" {
+		t.Errorf("%s through %s: unexpected message %q %v", rawURL, proxy.Scheme, data, err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newEchoTestServer() *Server {
+	wsServer := &Server{}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.WriteText(data)
+	})
+
+	return wsServer
+}
+
+func Test_DialerHTTPProxy(t *testing.T) {
+	wsURL := newTestServer(t, newEchoTestServer())
+	wssURL, _ := newTLSTestServer(t, newEchoTestServer())
+
+	proxy := newHTTPTestProxy(t, url.UserPassword("user", "secret"))
+
+	testDialThroughProxy(t, wsURL, proxy)
+	testDialThroughProxy(t, wssURL, proxy)
+
+	proxy.User = url.UserPassword("user", "wrong")
+
+	dialer := &Dialer{HandshakeTimeout: 5 * time.Second, Proxy: http.ProxyURL(proxy)}
+
+	var proxyErr *ProxyError
+
+	if _, err := dialer.Dial(wsURL, nil); !errors.As(err, &proxyErr) || proxyErr.Reason != "CONNECT status 407" {
+		t.Errorf("expected proxy error, got %v", err)
+	}
+
+	// any 2xx status opens the tunnel
+	accepted := serveTestProxy(t, func(c net.Conn, br *bufio.Reader) (string, bool) {
+		req, err := http.ReadRequest(br)
+
+		if err != nil {
+			return "", false
+		}
+
+		c.Write([]byte("HTTP/1.1 202 Accepted\r\n\r\n"))
+
+		return req.Host, true
+	})
+
+	testDialThroughProxy(t, wsURL, &url.URL{Scheme: "http", Host: accepted})
+}
+
+// Test_DefaultDialerProxyFromEnvironment run itself in a new process, the proxy of the
+// environment variables is read only once by the process
+func Test_DefaultDialerProxyFromEnvironment(t *testing.T) {
+	if os.Getenv("WEBSOCKET_TEST_PROXY_ENV") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^Test_DefaultDialerProxyFromEnvironment$")
+		cmd.Env = append(os.Environ(), "WEBSOCKET_TEST_PROXY_ENV=1")
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+
+		return
+	}
+
+	target, _ := url.Parse(newTestServer(t, newEchoTestServer()))
+	hosts := make(chan string, 1)
+
+	// the loopback address is never proxied, the proxy sends the example host to the test server
+	proxy := serveTestProxy(t, func(c net.Conn, br *bufio.Reader) (string, bool) {
+		req, err := http.ReadRequest(br)
+
+		if err != nil {
+			return "", false
+		}
+
+		hosts <- req.Host
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		return target.Host, true
+	})
+
+	t.Setenv("HTTP_PROXY", "http://"+proxy)
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", "")
+
+	client, err := DefaultDialer.Dial("ws://echo.example/ws", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if host := <-hosts; host != "echo.example:80" {
+		t.Errorf("expected CONNECT echo.example:80, got %s", host)
+	}
+
+	client.WriteText([]byte("through the proxy"))
+
+	if _, data, err := client.Read(); err != nil || string(data) != "through the proxy" {
+		t.Errorf("unexpected message %q %v", data, err)
+	}
+}
+
+func Test_DialerSOCKS5Proxy(t *testing.T) {
+	wsURL := newTestServer(t, newEchoTestServer())
+	wssURL, _ := newTLSTestServer(t, newEchoTestServer())
+
+	hosts := make(chan string, 8)
+
+	proxy := newSOCKS5TestProxy(t, url.UserPassword("user", "secret"), hosts)
+
+	testDialThroughProxy(t, wsURL, proxy)
+	testDialThroughProxy(t, wssURL, proxy)
+
+	<-hosts
+	<-hosts
+
+	// the host name is resolved by the proxy with socks5h and locally with socks5
+	u, _ := url.Parse(wsURL)
+
+	for scheme, expected := range map[string]string{"socks5h": "localhost", "socks5": "127.0.0.1"} {
+		proxy.Scheme = scheme
+		testDialThroughProxy(t, "ws://localhost:"+u.Port()+"/ws", proxy)
+
+		if host := <-hosts; host != expected {
+			t.Errorf("%s: expected the proxy to get %s, got %s", scheme, expected, host)
+		}
+	}
+
+	proxy.Scheme = "socks5"
+
+	proxy.User = url.UserPassword("user", "wrong")
+
+	dialer := &Dialer{HandshakeTimeout: 5 * time.Second, Proxy: http.ProxyURL(proxy)}
+
+	var proxyErr *ProxyError
+
+	if _, err := dialer.Dial(wsURL, nil); !errors.As(err, &proxyErr) || proxyErr.Reason != "authentication failed" {
+		t.Errorf("expected proxy error, got %v", err)
+	}
+}
+
+func Test_DialerProxyRequest(t *testing.T) {
+	var schemes []string
+
+	dialer := &Dialer{
+		HandshakeTimeout: time.Second,
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			schemes = append(schemes, req.URL.Scheme)
+			return &url.URL{Scheme: "ftp", Host: "127.0.0.1:1"}, nil
+		},
+	}
+
+	for _, rawURL := range []string{"ws://example.com/ws", "wss://example.com/ws"} {
+		if _, err := dialer.Dial(rawURL, nil); err != ErrUnsupportedProxy {
+			t.Errorf("expected %v, got %v", ErrUnsupportedProxy, err)
+		}
+	}
+
+	// the environment variables are matched by the http and https schemes
+	if len(schemes) != 2 || schemes[0] != "http" || schemes[1] != "https" {
+		t.Errorf("unexpected proxy request schemes %v", schemes)
+	}
+}
@@ -0,0 +1,416 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBufferFull shows up when writing on the disconnected ReconnectingClient holding MaxBufferedMessages messages
+	ErrBufferFull = errors.New("websocket: the buffer of the disconnected client is full")
+
+	// ErrReconnectingClientClosed shows up when writing on the ReconnectingClient after it stops
+	ErrReconnectingClientClosed = errors.New("websocket: reconnecting client is closed")
+)
+
+const (
+	defaultMinBackoff          = 500 * time.Millisecond
+	defaultMaxBackoff          = 30 * time.Second
+	defaultMaxBufferedMessages = 256
+	stateChanSize              = 16
+)
+
+// ReconnectState is the state of the connection of the ReconnectingClient
+type ReconnectState int
+
+const (
+	// StateConnecting is dialing the server
+	StateConnecting ReconnectState = iota
+	// StateConnected is connected and the messages are sent right away
+	StateConnected
+	// StateDisconnected is waiting the backoff before the next dial, the messages are buffered
+	StateDisconnected
+	// StateClosed is the end, the client never reconnects again
+	StateClosed
+)
+
+func (s ReconnectState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+
+	return "unknown"
+}
+
+// ReconnectingClient keep a started Client connected to the url, the connection is
+// dialed again with exponential backoff and jitter when it ends. It is safe for concurrent use
+type ReconnectingClient struct {
+	// URL is the websocket url of the server
+	URL string
+
+	// Dialer dial the server, default is the DefaultDialer
+	Dialer *Dialer
+
+	// Header is added to every opening handshake
+	Header http.Header
+
+	// MinBackoff and MaxBackoff are the bounds of the wait between the dials, the
+	// wait doubles after every failed dial and every connection dropped before
+	// MinBackoff. Default is 500 milliseconds and 30 seconds
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxBufferedMessages is the max number of messages kept while disconnected, they
+	// are sent once connected again. Default is 256, a negative value means no buffer
+	MaxBufferedMessages int
+
+	messageHandler MessageHandler
+	onReconnect    func(c *Client)
+
+	mutex    sync.Mutex
+	client   *Client
+	buffer   []bufferedMessage
+	closed   bool
+	started  bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+	stateMux sync.Mutex
+	states   chan ReconnectState
+}
+
+type bufferedMessage struct {
+	messageType FrameTypeCode
+	data        []byte
+}
+
+// SetMessageHandler set the handler of the messages from the server, it must be set before Start
+func (r *ReconnectingClient) SetMessageHandler(messageHandler MessageHandler) {
+	r.messageHandler = messageHandler
+}
+
+// OnReconnect set the hook called every time the connection is up, the first one
+// included, before the buffered messages are sent. It is the place to send the
+// subscriptions again, it must be set before Start
+func (r *ReconnectingClient) OnReconnect(onReconnect func(c *Client)) {
+	r.onReconnect = onReconnect
+}
+
+// States return the channel of the state changes, it is closed after StateClosed.
+// The changes are dropped when the channel is full
+func (r *ReconnectingClient) States() <-chan ReconnectState {
+	r.stateMux.Lock()
+	defer r.stateMux.Unlock()
+
+	if r.states == nil {
+		r.states = make(chan ReconnectState, stateChanSize)
+	}
+
+	return r.states
+}
+
+// Start connect to the server in the background and keep reconnecting until the
+// context is cancelled or Close is called
+func (r *ReconnectingClient) Start(ctx context.Context) {
+	r.States()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.started || r.closed {
+		return
+	}
+
+	r.started = true
+	r.done = make(chan struct{})
+
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	go r.run(ctx)
+}
+
+// Close stop reconnecting and close the current connection, the buffered messages are
+// dropped. The writes blocked on the stalled server return once the connection ends
+func (r *ReconnectingClient) Close() {
+	r.mutex.Lock()
+
+	r.closed = true
+	r.buffer = nil
+	cancel, done := r.cancel, r.done
+
+	r.mutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// Write send p as a text message
+func (r *ReconnectingClient) Write(p []byte) error {
+	return r.WriteMessage(TextMessage, p)
+}
+
+// WriteText send data as a text message
+func (r *ReconnectingClient) WriteText(data []byte) error {
+	return r.WriteMessage(TextMessage, data)
+}
+
+// WriteBinary send data as a binary message
+func (r *ReconnectingClient) WriteBinary(data []byte) error {
+	return r.WriteMessage(BinaryMessage, data)
+}
+
+// WriteMessage send the data message when connected, otherwise the message is
+// buffered until the connection is up again. The message queued on the
+// connection dropping at the same time can be lost
+func (r *ReconnectingClient) WriteMessage(messageType FrameTypeCode, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return ErrInvalidMessageType
+	}
+
+	if err := checkMessage(messageType, data); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+
+	if r.closed {
+		r.mutex.Unlock()
+		return ErrReconnectingClientClosed
+	}
+
+	client := r.client
+
+	if client == nil {
+		err := r.bufferMessage(messageType, data)
+		r.mutex.Unlock()
+
+		return err
+	}
+
+	r.mutex.Unlock()
+
+	// the write may wait the stalled server, the lock is not held meanwhile
+	if err := client.WriteMessage(messageType, data); err == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return ErrReconnectingClientClosed
+	}
+
+	// the connection is going down, the message waits the next one
+	if r.client == client {
+		r.client = nil
+	}
+
+	return r.bufferMessage(messageType, data)
+}
+
+func (r *ReconnectingClient) bufferMessage(messageType FrameTypeCode, data []byte) error {
+	limit := r.MaxBufferedMessages
+
+	if limit == 0 {
+		limit = defaultMaxBufferedMessages
+	}
+
+	if len(r.buffer) >= limit {
+		return ErrBufferFull
+	}
+
+	r.buffer = append(r.buffer, bufferedMessage{
+		messageType: messageType,
+		data:        append([]byte(nil), data...),
+	})
+
+	return nil
+}
+
+// run dial the server and wait the connection to end until the context is cancelled
+func (r *ReconnectingClient) run(ctx context.Context) {
+	defer close(r.done)
+
+	dialer := r.Dialer
+
+	if dialer == nil {
+		dialer = DefaultDialer
+	}
+
+	for attempt := 0; ; attempt++ {
+		r.setState(StateConnecting)
+
+		client, err := dialer.DialContext(ctx, r.URL, r.Header)
+
+		if err == nil {
+			connected := time.Now()
+
+			if !r.serve(ctx, client) {
+				break
+			}
+
+			// the connection which stayed up starts the backoff again, the server
+			// accepting and dropping at once keeps the wait growing
+			if time.Since(connected) > r.minBackoff() {
+				attempt = 0
+			}
+		} else if ctx.Err() != nil {
+			break
+		}
+
+		r.setState(StateDisconnected)
+
+		// the clients dropped together by a deploy do not dial again at once
+		if !sleepContext(ctx, r.backoff(attempt)) {
+			break
+		}
+	}
+
+	r.mutex.Lock()
+	r.closed = true
+	r.buffer = nil
+	r.mutex.Unlock()
+
+	r.setState(StateClosed)
+	close(r.states)
+}
+
+// serve start the client and wait it to end, it return false when the context is cancelled
+func (r *ReconnectingClient) serve(ctx context.Context, client *Client) bool {
+	client.SetMessageHandler(r.messageHandler)
+
+	if err := client.Start(); err != nil {
+		client.c.Close()
+		return ctx.Err() == nil
+	}
+
+	// the cancel closes the connection, the writes blocked on the stalled server give up
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-client.done:
+		case <-ctx.Done():
+			client.Close()
+		}
+	}()
+
+	if r.onReconnect != nil {
+		r.onReconnect(client)
+	}
+
+	r.flush(client)
+
+	r.setState(StateConnected)
+
+	<-client.done
+	<-stopped
+
+	r.mutex.Lock()
+
+	if r.client == client {
+		r.client = nil
+	}
+
+	r.mutex.Unlock()
+
+	return ctx.Err() == nil
+}
+
+// flush send the buffered messages in order before the client takes the new writes,
+// the lock is not held while writing so a stalled server never blocks the writers
+func (r *ReconnectingClient) flush(client *Client) {
+	for {
+		r.mutex.Lock()
+
+		if len(r.buffer) == 0 {
+			r.client = client
+			r.mutex.Unlock()
+
+			return
+		}
+
+		message := r.buffer[0]
+		r.buffer = r.buffer[1:]
+
+		r.mutex.Unlock()
+
+		if err := client.WriteMessage(message.messageType, message.data); err != nil {
+			// the connection is going down, the message waits the next one
+			r.mutex.Lock()
+
+			if !r.closed {
+				r.buffer = append([]bufferedMessage{message}, r.buffer...)
+			}
+
+			r.mutex.Unlock()
+
+			return
+		}
+	}
+}
+
+// backoff return the wait before the dial after the attempts, it doubles up
+// to MaxBackoff and the jitter picks a random wait in the upper half
+func (r *ReconnectingClient) backoff(attempt int) time.Duration {
+	minBackoff, maxBackoff := r.minBackoff(), r.MaxBackoff
+
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	wait := minBackoff
+
+	for i := 0; i < attempt && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func (r *ReconnectingClient) minBackoff() time.Duration {
+	if r.MinBackoff <= 0 {
+		return defaultMinBackoff
+	}
+
+	return r.MinBackoff
+}
+
+func (r *ReconnectingClient) setState(state ReconnectState) {
+	select {
+	case r.states <- state:
+	default:
+	}
+}
+
+// sleepContext wait the duration, it return false when the context is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
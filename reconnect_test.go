@@ -0,0 +1,270 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func Test_ReconnectingClient(t *testing.T) {
+	received := make(chan string, 16)
+
+	wsServer := &Server{}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		received <- string(data)
+
+		// the deploy of the server drops the connection
+		if string(data) == "drop" {
+			c.CloseWithReason(WebsocketStatusCodeGoingAway, "deploy")
+		}
+	})
+
+	client := &ReconnectingClient{
+		URL:                 newTestServer(t, wsServer),
+		MinBackoff:          10 * time.Millisecond,
+		MaxBufferedMessages: 2,
+	}
+
+	reconnects := make(chan struct{}, 4)
+
+	client.OnReconnect(func(c *Client) {
+		c.WriteText([]byte("subscribe"))
+		reconnects <- struct{}{}
+	})
+
+	states := client.States()
+
+	// the messages before the first connection are buffered
+	client.WriteText([]byte("first"))
+	client.WriteText([]byte("second"))
+
+	if err := client.WriteText([]byte("third")); err != ErrBufferFull {
+		t.Errorf("expected %v, got %v", ErrBufferFull, err)
+	}
+
+	client.Start(context.Background())
+
+	expectMessages := func(messages ...string) {
+		t.Helper()
+
+		for _, expected := range messages {
+			select {
+			case data := <-received:
+				if data != expected {
+					t.Fatalf("expected %q, got %q", expected, data)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("message %q not received", expected)
+			}
+		}
+	}
+
+	// the subscriptions go before the buffered messages
+	expectMessages("subscribe", "first", "second")
+
+	client.WriteText([]byte("drop"))
+
+	expectMessages("drop", "subscribe")
+
+	if len(reconnects) != 2 {
+		t.Errorf("expected 2 reconnects, got %d", len(reconnects))
+	}
+
+	client.Close()
+
+	if err := client.WriteText([]byte("after close")); err != ErrReconnectingClientClosed {
+		t.Errorf("expected %v, got %v", ErrReconnectingClientClosed, err)
+	}
+
+	var changes []ReconnectState
+
+	for state := range states {
+		changes = append(changes, state)
+	}
+
+	expected := []ReconnectState{StateConnecting, StateConnected, StateDisconnected, StateConnecting, StateConnected, StateClosed}
+
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, changes)
+		}
+	}
+}
+
+func Test_ReconnectingClientCancel(t *testing.T) {
+	// nothing listens on the address so every dial fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln.Close()
+
+	client := &ReconnectingClient{
+		URL:        "ws://" + ln.Addr().String() + "/ws",
+		MinBackoff: time.Hour,
+	}
+
+	states := client.States()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	client.Start(ctx)
+
+	// the cancel stops the backoff wait
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	var last ReconnectState
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for state := range states {
+			last = state
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client did not stop")
+	}
+
+	if last != StateClosed {
+		t.Errorf("expected %v, got %v", StateClosed, last)
+	}
+}
+
+func Test_ReconnectingClientDropBackoff(t *testing.T) {
+	var dials atomic.Int64
+
+	wsServer := &Server{}
+
+	// the server accepts and drops every connection
+	wsServer.OnOpen(func(c *Conn) {
+		dials.Add(1)
+		c.CloseWithReason(WebsocketStatusCodeServiceRestart, "restart")
+	})
+
+	client := &ReconnectingClient{
+		URL:        newTestServer(t, wsServer),
+		MinBackoff: 50 * time.Millisecond,
+		MaxBackoff: 100 * time.Millisecond,
+	}
+
+	client.Start(context.Background())
+
+	time.Sleep(500 * time.Millisecond)
+
+	client.Close()
+
+	// the wait is at least 25 milliseconds before every dial after the first
+	if n := dials.Load(); n < 2 || n > 21 {
+		t.Errorf("expected the dials to wait the backoff, got %d dials in 500 milliseconds", n)
+	}
+}
+
+func Test_ReconnectingClientBackoff(t *testing.T) {
+	client := &ReconnectingClient{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: time.Second,
+	}
+
+	for attempt, limit := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		for i := 0; i < 20; i++ {
+			if wait := client.backoff(attempt); wait < limit/2 || wait > limit {
+				t.Fatalf("attempt %d: wait %v out of [%v, %v]", attempt, wait, limit/2, limit)
+			}
+		}
+	}
+}
+
+func Test_ReconnectingClientStalledServer(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	// the server accepts the connection and never reads it
+	url := newRawTestServer(t, func(c net.Conn, req *fasthttp.Request) {
+		accept := computeAcceptKey(req.Header.PeekBytes(websocketKeyString))
+
+		c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + string(accept) + "\r\n\r\n"))
+
+		<-release
+	})
+
+	client := &ReconnectingClient{
+		URL:    url,
+		Dialer: &Dialer{HandshakeTimeout: 5 * time.Second},
+	}
+
+	connected := make(chan struct{})
+
+	client.OnReconnect(func(c *Client) {
+		close(connected)
+	})
+
+	client.Start(context.Background())
+
+	<-connected
+
+	var written atomic.Int64
+
+	writerDone := make(chan struct{})
+
+	go func() {
+		defer close(writerDone)
+
+		data := make([]byte, 64<<10)
+
+		for client.WriteBinary(data) == nil {
+			written.Add(1)
+		}
+	}()
+
+	// the writes stop once the socket buffers and the write queue are full
+	for last := int64(-1); last != written.Load(); {
+		last = written.Load()
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close blocked on the stalled server")
+	}
+
+	select {
+	case <-writerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write blocked on the stalled server never returned")
+	}
+}
@@ -0,0 +1,93 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrTooManyRedirects shows up when the opening handshake is redirected more than MaxRedirects times
+var ErrTooManyRedirects = errors.New("websocket: stopped after too many redirects")
+
+const defaultMaxRedirects = 10
+
+// redirectLocation return the location of the handshake redirected by 301, 302, 307 or 308
+func redirectLocation(err error) (string, bool) {
+	var handshakeErr *HandshakeError
+
+	if !errors.As(err, &handshakeErr) {
+		return "", false
+	}
+
+	switch handshakeErr.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return "", false
+	}
+
+	location := handshakeErr.Header.Get("Location")
+
+	return location, location != ""
+}
+
+// redirect return the request of the next hop to the location relative to the last
+// request of via, the http scheme is turned into ws and https into wss. The credentials
+// of the header are dropped when the redirect goes to another host
+func (d *Dialer) redirect(location string, via []*http.Request) (*http.Request, error) {
+	maxRedirects := d.MaxRedirects
+
+	if maxRedirects == 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+
+	// via has the first request which is not a redirect
+	if len(via) > maxRedirects {
+		return nil, ErrTooManyRedirects
+	}
+
+	u, header := via[len(via)-1].URL, via[len(via)-1].Header
+
+	next, err := u.Parse(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch next.Scheme {
+	case "http":
+		next.Scheme = "ws"
+	case "https":
+		next.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return nil, ErrBadScheme
+	}
+
+	// the user info of the url is only for its own host
+	if next.User == nil && next.Host == u.Host {
+		next.User = u.User
+	}
+
+	header = header.Clone()
+
+	if !strings.EqualFold(next.Hostname(), u.Hostname()) {
+		for _, name := range []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2"} {
+			header.Del(name)
+		}
+	}
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    next,
+		Header: header,
+		Host:   next.Host,
+	}
+
+	if d.CheckRedirect != nil {
+		if err := d.CheckRedirect(req, via); err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func Test_DialerRedirect(t *testing.T) {
+	keys := make(chan string, 8)
+	authorizations := make(chan string, 1)
+
+	wsServer := &Server{
+		CheckOrigin: func(ctx *fasthttp.RequestCtx) bool {
+			keys <- string(ctx.Request.Header.PeekBytes(websocketKeyString))
+			authorizations <- string(ctx.Request.Header.Peek("Authorization"))
+			return true
+		},
+	}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.WriteText(data)
+	})
+
+	target, _ := url.Parse(newTestServer(t, wsServer))
+
+	// the regional host is another name of the same server
+	regional := "http://localhost:" + target.Port() + "/ws"
+
+	redirector := newRawTestServer(t, func(c net.Conn, req *fasthttp.Request) {
+		keys <- string(req.Header.PeekBytes(websocketKeyString))
+
+		switch string(req.RequestURI()) {
+		case "/ws":
+			c.Write([]byte("HTTP/1.1 307 Temporary Redirect\r\nLocation: /regional\r\nContent-Length: 0\r\n\r\n"))
+		default:
+			c.Write([]byte("HTTP/1.1 301 Moved Permanently\r\nLocation: " + regional + "\r\nContent-Length: 0\r\n\r\n"))
+		}
+	})
+
+	var hops []string
+
+	dialer := &Dialer{
+		HandshakeTimeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			hops = append(hops, req.URL.String())
+			return nil
+		},
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer token")
+
+	client, err := dialer.Dial(redirector, header)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if final := "ws://localhost:" + target.Port() + "/ws"; client.URL().String() != final {
+		t.Errorf("expected the final url %s, got %s", final, client.URL())
+	}
+
+	if len(hops) != 2 || !strings.HasSuffix(hops[0], "/regional") || !strings.HasPrefix(hops[1], "ws://localhost:") {
+		t.Errorf("unexpected hops %v", hops)
+	}
+
+	// every hop has its own key
+	seen := map[string]bool{}
+
+	for i := 0; i < 3; i++ {
+		seen[<-keys] = true
+	}
+
+	if len(seen) != 3 {
+		t.Errorf("the key should be fresh on every hop, got %v", seen)
+	}
+
+	// the credentials do not follow the redirect to another host
+	if authorization := <-authorizations; authorization != "" {
+		t.Errorf("the authorization went to another host %q", authorization)
+	}
+
+	client.WriteText([]byte("redirected"))
+
+	if _, data, err := client.Read(); err != nil || string(data) != "redirected" {
+		t.Errorf("unexpected message %q %v", data, err)
+	}
+}
+
+func Test_DialerRedirectRejected(t *testing.T) {
+	var requests atomic.Int64
+
+	loop := newRawTestServer(t, func(c net.Conn, req *fasthttp.Request) {
+		requests.Add(1)
+		c.Write([]byte("HTTP/1.1 302 Found\r\nLocation: /ws\r\nContent-Length: 0\r\n\r\n"))
+	})
+
+	if _, err := (&Dialer{HandshakeTimeout: 5 * time.Second, MaxRedirects: 3}).Dial(loop, nil); err != ErrTooManyRedirects {
+		t.Errorf("expected %v, got %v", ErrTooManyRedirects, err)
+	}
+
+	if requests.Load() != 4 {
+		t.Errorf("expected 4 requests, got %d", requests.Load())
+	}
+
+	var handshakeErr *HandshakeError
+
+	if _, err := (&Dialer{HandshakeTimeout: 5 * time.Second, MaxRedirects: -1}).Dial(loop, nil); !errors.As(err, &handshakeErr) || handshakeErr.StatusCode != http.StatusFound {
+		t.Errorf("expected the 302 handshake error, got %v", err)
+	}
+
+	errCrossHost := errors.New("cross host redirect")
+
+	crossHost := newRawTestServer(t, func(c net.Conn, req *fasthttp.Request) {
+		c.Write([]byte("HTTP/1.1 308 Permanent Redirect\r\nLocation: wss://example.com/ws\r\nContent-Length: 0\r\n\r\n"))
+	})
+
+	dialer := &Dialer{
+		HandshakeTimeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host != via[0].URL.Host {
+				return errCrossHost
+			}
+
+			return nil
+		},
+	}
+
+	if _, err := dialer.Dial(crossHost, nil); err != errCrossHost {
+		t.Errorf("expected %v, got %v", errCrossHost, err)
+	}
+}
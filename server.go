@@ -3,7 +3,11 @@ package websocket
 import (
 	"bytes"
 	"context"
+	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/valyala/fasthttp"
 )
@@ -12,11 +16,27 @@ type (
 	// MessageHandler handle the frame type is text message from client
 	MessageHandler func(c *Conn, isBinary bool, data []byte)
 
-	// PingHandler handle the frame type is ping from client
+	// PingHandler handle the frame type is ping from client, it replaces the default
+	// handler which answers the ping with a pong of the same payload
 	PingHandler func(c *Conn, data []byte)
 
 	// PongHandler handle the frame type is pong from client
 	PongHandler func(c *Conn, data []byte)
+
+	// ConnHandler handle the connection by itself with Conn.NextReader and Conn.NextWriter
+	// instead of the MessageHandler, the connection is closed after it returns
+	ConnHandler func(c *Conn)
+
+	// CloseHandler handle the end of the connection, the code and the reason are of the close
+	// frame from the peer, the code is WebsocketStatusCodeAbnormalClosure without close frame
+	CloseHandler func(c *Conn, code WebsocketStatusCode, reason string)
+
+	// OpenHandler handle the new connection before any frame from the client is handled
+	OpenHandler func(c *Conn)
+
+	// ErrorHandler handle the protocol, read or write error which failed the connection, c is
+	// nil and err is *AuthorizeError when the upgrade is refused by Authorize
+	ErrorHandler func(c *Conn, err error)
 )
 
 const (
@@ -49,11 +69,101 @@ func routineMonitor() {
 type Server struct {
 	CheckOrigin func(ctx *fasthttp.RequestCtx) bool
 
+	// DisableUTF8Validation skip the UTF-8 check of the text message and the close reason
+	DisableUTF8Validation bool
+
+	// ReadLimit is the max size in bytes of a frame or a reassembled message from the
+	// client, the connection is closed with 1009 when it is over. Default is 32 MB,
+	// a negative value means no limit
+	ReadLimit int64
+
+	// PingInterval is how often the server send a ping to the client, no ping is sent when it is zero
+	PingInterval time.Duration
+
+	// PongTimeout is how long to wait the pong after a ping, the connection is closed with
+	// 1001 when the pong does not arrive in time. Default is the PingInterval
+	PongTimeout time.Duration
+
+	// IdleTimeout close the connection with 1001 when nothing arrives from the client
+	// in the timeout, the connection never idles out when it is zero
+	IdleTimeout time.Duration
+
+	// WriteTimeout is the deadline of writing every frame to the client, the connection
+	// is torn down when the client does not take the frame in time
+	WriteTimeout time.Duration
+
+	// CloseTimeout is how long to wait the close frame from the client after the
+	// server sent the close frame, default is 5 seconds
+	CloseTimeout time.Duration
+
+	// Subprotocols are the Sec-WebSocket-Protocol supported by the server, the first one
+	// offered by the client is selected, no subprotocol is selected when none matches
+	Subprotocols []string
+
+	// SelectSubprotocol select the subprotocol among the offered ones of the client
+	// instead of Subprotocols, no subprotocol is selected when it returns the empty
+	// string or the subprotocol which is not offered
+	SelectSubprotocol func(ctx *fasthttp.RequestCtx, offered []string) string
+
+	// Authorize is called before the 101 response, the upgrade is refused by the status
+	// and the header when err is not nil, the status is 403 when it is zero and the
+	// body is the error message unless Authorize set the body of the response. The
+	// header is added to the 101 response when err is nil. The refusal is reported to OnError
+	Authorize func(ctx *fasthttp.RequestCtx) (status int, header http.Header, err error)
+
+	// RequestHeaders are the names of the headers of the opening handshake kept on the
+	// Conn, all the headers are kept when it is empty
+	RequestHeaders []string
+
+	// BeforeUpgrade is called right before the 101 response, the values set on locals
+	// are attached to the Conn. The user values of the ctx are already in locals
+	BeforeUpgrade func(ctx *fasthttp.RequestCtx, locals *Locals)
+
+	// ReadBufferSize and WriteBufferSize are the sizes of the buffers of the connection,
+	// default is 4096. The frames bigger than the read buffer are read in chunks and
+	// the streamed message is written in frames of the write buffer size
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// ReadQueueSize and WriteQueueSize are how many frames wait to be handled and to be
+	// written on the connection, default is 128. The writes block when the queue is full
+	ReadQueueSize  int
+	WriteQueueSize int
+
+	// UpgradeWriteTimeout is the write deadline of the 101 response from the time the
+	// upgrade is accepted, it is cleared once the connection is hijacked. It does not
+	// bound reading the request, that is the ReadTimeout of the fasthttp server, and the
+	// WriteTimeout of the fasthttp server replaces it when set. There is no limit when it is zero
+	UpgradeWriteTimeout time.Duration
+
+	// Hub register the connections of the server when it is set, the connection is
+	// added before OnOpen and removed before OnClose
+	Hub *Hub
+
+	// EnableCompression accept the permessage-deflate offer of the client, the messages
+	// are compressed both ways when it is negotiated
+	EnableCompression bool
+
+	// CompressionLevel is the flate level of the compressed messages, default is flate.BestSpeed
+	CompressionLevel int
+
+	// CompressionThreshold is the min size of the data message compressed by WriteMessage,
+	// the smaller message is sent uncompressed
+	CompressionThreshold int
+
 	messageHandler MessageHandler
 
 	pingHandler PingHandler
 
 	pongHandler PongHandler
+
+	connHandler ConnHandler
+
+	openHandler OpenHandler
+
+	closeHandler CloseHandler
+
+	errorHandler ErrorHandler
 }
 
 func (s *Server) SetMessageHandler(messageHandler MessageHandler) {
@@ -68,6 +178,29 @@ func (s *Server) SetPongHandler(pongHandler PongHandler) {
 	s.pongHandler = pongHandler
 }
 
+// SetConnHandler let the handler read and write the messages of the connection as
+// streams, the MessageHandler is not used when it is set
+func (s *Server) SetConnHandler(connHandler ConnHandler) {
+	s.connHandler = connHandler
+}
+
+// OnOpen set the handler called when the connection is upgraded, before the first
+// frame from the client is handled
+func (s *Server) OnOpen(openHandler OpenHandler) {
+	s.openHandler = openHandler
+}
+
+// OnClose set the handler called once when the connection ends, whoever closes it
+func (s *Server) OnClose(closeHandler CloseHandler) {
+	s.closeHandler = closeHandler
+}
+
+// OnError set the handler called before OnClose when the connection ends by a protocol,
+// read or write error, and when Authorize refuses the upgrade
+func (s *Server) OnError(errorHandler ErrorHandler) {
+	s.errorHandler = errorHandler
+}
+
 // Upgrade upgrade http connection to websocket connection
 func (s *Server) Upgrade(ctx *fasthttp.RequestCtx) {
 	// websocket header Connection value should be Upgrade
@@ -117,20 +250,70 @@ func (s *Server) Upgrade(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if s.Authorize != nil && !s.authorize(ctx) {
+		return
+	}
+
 	// compute Sec-WebSocket-Accept key
 	acceptKey := computeAcceptKey(websocketKey)
 	ctx.Response.Header.SetBytesKV(websocketAcceptString, acceptKey)
 
+	config := s.connConfig()
+
+	if s.EnableCompression {
+		offers := bytes.Join(ctx.Request.Header.PeekAll(string(websocketExtensionsString)), []byte(","))
+
+		if params, response, ok := negotiateCompression(string(offers)); ok {
+			ctx.Response.Header.SetBytesK(websocketExtensionsString, response)
+
+			config.compression = &compressionOptions{
+				params:    params,
+				level:     s.CompressionLevel,
+				threshold: s.CompressionThreshold,
+			}
+		}
+	}
+
+	if config.subprotocol = s.selectSubprotocol(ctx); config.subprotocol != "" {
+		ctx.Response.Header.SetBytesK(websocketProtocolString, config.subprotocol)
+	}
+
+	// the ctx is gone after the hijack
+	config.request = s.handshakeRequest(ctx)
+	config.locals = &Locals{}
+
+	ctx.VisitUserValuesAll(func(key, value interface{}) {
+		config.locals.Set(key, value)
+	})
+
+	if s.BeforeUpgrade != nil {
+		s.BeforeUpgrade(ctx, config.locals)
+	}
+
 	ctx.Response.Header.SetBytesKV(upgradeString, webSocketString)
 	ctx.Response.Header.SetBytesKV(connectionString, upgradeString)
 	ctx.Response.SetStatusCode(fasthttp.StatusSwitchingProtocols)
 
+	// the 101 response is written by fasthttp after the handler returns
+	if s.UpgradeWriteTimeout > 0 {
+		ctx.Conn().SetWriteDeadline(time.Now().Add(s.UpgradeWriteTimeout))
+	}
+
 	// hijack the connection to let's server handle the connection
 	ctx.Hijack(func(c net.Conn) {
+		if s.UpgradeWriteTimeout > 0 {
+			c.SetWriteDeadline(time.Time{})
+		}
+
+		// the hijacked conn Close does nothing unless the fasthttp server keeps the
+		// hijacked connections, close the underlying conn to be able to tear it down
+		if hijacked, ok := c.(interface{ UnsafeConn() net.Conn }); ok {
+			c = &hijackedConn{Conn: c, underlying: hijacked.UnsafeConn()}
+		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 
-		conn := NewConn(ctx, c, cancel)
+		conn := newConn(ctx, c, cancel, config)
 
 		s.serverConn(ctx, conn)
 	})
@@ -138,75 +321,198 @@ func (s *Server) Upgrade(ctx *fasthttp.RequestCtx) {
 	return
 }
 
-func (s *Server) serverConn(ctx context.Context, conn *Conn) {
+// ServeConn serve the connection which already finished the opening handshake by the
+// handlers of the server, like a Unix socket or a net.Pipe. It returns when the connection
+// ends. The io.ReadWriteCloser which is not a net.Conn has no deadline, so the
+// timeouts of the server do not work on it
+func (s *Server) ServeConn(c io.ReadWriteCloser) {
+	ctx, cancel := context.WithCancel(context.Background())
 
-loop:
-	for {
-		select {
-		case <-conn.ctx.Done():
-			break loop
-		case frame := <-conn.ReadChan:
-			s.frameHandler(conn, frame)
-			ReleaseFrame(frame)
-
-			if conn.isClose {
-				break loop
-			}
+	conn := newConn(ctx, toNetConn(c), cancel, s.connConfig())
+
+	s.serverConn(ctx, conn)
+}
+
+// authorize run the Authorize hook, it return false when the upgrade is refused
+func (s *Server) authorize(ctx *fasthttp.RequestCtx) bool {
+	status, header, err := s.Authorize(ctx)
+
+	for name, values := range header {
+		for _, value := range values {
+			ctx.Response.Header.Add(name, value)
 		}
 	}
 
-	// clean all the channel data prevent goroutine leak
-	conn.c.Close()
+	if err == nil {
+		return true
+	}
+
+	if status == 0 {
+		status = fasthttp.StatusForbidden
+	}
+
+	ctx.Response.SetStatusCode(status)
+
+	if len(ctx.Response.Body()) == 0 {
+		ctx.Response.SetBodyString(err.Error())
+	}
+
+	if s.errorHandler != nil {
+		s.errorHandler(nil, &AuthorizeError{StatusCode: status, Err: err})
+	}
+
+	return false
+}
+
+// handshakeRequest copy the data of the opening handshake kept on the conn
+func (s *Server) handshakeRequest(ctx *fasthttp.RequestCtx) *handshakeRequest {
+	request := &handshakeRequest{
+		header:   http.Header{},
+		path:     string(ctx.Path()),
+		query:    url.Values{},
+		tlsState: ctx.TLSConnectionState(),
+	}
 
-	for len(conn.ReadChan) > 0 {
-		fr, ok := <-conn.ReadChan
+	keep := make(map[string]bool, len(s.RequestHeaders))
 
-		if !ok {
-			break
+	for _, name := range s.RequestHeaders {
+		keep[http.CanonicalHeaderKey(name)] = true
+	}
+
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		name := http.CanonicalHeaderKey(string(key))
+
+		if len(keep) == 0 || keep[name] {
+			request.header.Add(name, string(value))
 		}
+	})
+
+	ctx.QueryArgs().VisitAll(func(key, value []byte) {
+		request.query.Add(string(key), string(value))
+	})
+
+	ctx.Request.Header.VisitAllCookie(func(key, value []byte) {
+		request.cookies = append(request.cookies, &http.Cookie{Name: string(key), Value: string(value)})
+	})
 
-		if !fr.IsControl() {
-			s.frameHandler(conn, fr)
+	return request
+}
+
+// selectSubprotocol return the subprotocol of the server among the offered ones of the client
+func (s *Server) selectSubprotocol(ctx *fasthttp.RequestCtx) string {
+	offered := parseSubprotocols(ctx.Request.Header.PeekAll(string(websocketProtocolString)))
+
+	if len(offered) == 0 {
+		return ""
+	}
+
+	if s.SelectSubprotocol != nil {
+		if selected := s.SelectSubprotocol(ctx, offered); containsToken(offered, selected) {
+			return selected
 		}
 
-		ReleaseFrame(fr)
+		return ""
 	}
 
-	conn.waitGroup.Wait()
+	for _, subprotocol := range offered {
+		if containsToken(s.Subprotocols, subprotocol) {
+			return subprotocol
+		}
+	}
+
+	return ""
 }
 
-func (s *Server) frameHandler(conn *Conn, frame *Frame) {
-	if frame.IsControl() {
-		switch frame.frameType {
-		case codeClose:
-			s.closeHandler(conn, frame)
-		case codePing:
-			if s.pingHandler != nil {
-				s.pingHandler(conn, frame.payload)
-			}
+func (s *Server) connConfig() connConfig {
+	config := connConfig{
+		isServer:     true,
+		validateUTF8: !s.DisableUTF8Validation,
+		closeTimeout: s.CloseTimeout,
+		readLimit:    s.ReadLimit,
+		pingHandler:  s.pingHandler,
+		pongHandler:  s.pongHandler,
+		pingInterval: s.PingInterval,
+		pongTimeout:  s.PongTimeout,
+		idleTimeout:  s.IdleTimeout,
+		writeTimeout: s.WriteTimeout,
+
+		readBufferSize:  s.ReadBufferSize,
+		writeBufferSize: s.WriteBufferSize,
+		readQueueSize:   s.ReadQueueSize,
+		writeQueueSize:  s.WriteQueueSize,
+	}
 
-		case codePong:
-			if s.pongHandler != nil {
-				s.pongHandler(conn, frame.payload)
-			}
-		}
-	} else {
-		s.dataFrameHandler(conn, frame)
+	if config.pongTimeout <= 0 {
+		config.pongTimeout = config.pingInterval
+	}
+
+	if config.readLimit == 0 {
+		config.readLimit = defaultReadLimit
 	}
+
+	if config.closeTimeout <= 0 {
+		config.closeTimeout = defaultCloseTimeout
+	}
+
+	return config
 }
 
-func (s *Server) closeHandler(conn *Conn, frame *Frame) {
-	conn.Close()
+func (s *Server) serverConn(ctx context.Context, conn *Conn) {
+	if s.Hub != nil {
+		conn.startBroadcasts()
+		s.Hub.register(conn)
+	}
+
+	if s.openHandler != nil {
+		s.openHandler(conn)
+	}
+
+	defer s.connClosed(conn)
+
+	if s.connHandler != nil {
+		s.connHandler(conn)
+
+		// the handler returns without the close handshake
+		conn.writeClose(WebsocketStatusCodeNormalClosure, "")
+		conn.shutdown(nil)
+
+		return
+	}
+
+	conn.messageLoop(s.messageHandler)
+
+	conn.shutdown(func(frame *Frame) {
+		conn.dataFrameHandler(s.messageHandler, frame)
+	})
 }
 
-func (s *Server) dataFrameHandler(conn *Conn, frame *Frame) {
-	if s.messageHandler != nil {
-		isBinary := frame.frameType == codeBinary
+// connClosed report the error and the close of the connection after it ends
+func (s *Server) connClosed(conn *Conn) {
+	if s.Hub != nil {
+		s.Hub.unregister(conn)
+	}
+
+	if err := conn.Err(); err != nil && s.errorHandler != nil {
+		s.errorHandler(conn, err)
+	}
 
-		s.messageHandler(conn, isBinary, frame.payload)
+	if s.closeHandler != nil {
+		closeErr := conn.closeStatus()
+		s.closeHandler(conn, closeErr.Code, closeErr.Text)
 	}
 }
 
+// hijackedConn read from the fasthttp hijacked conn which keeps the buffered
+// data after the handshake, and close the underlying conn
+type hijackedConn struct {
+	net.Conn
+	underlying net.Conn
+}
+
+func (c *hijackedConn) Close() error {
+	return c.underlying.Close()
+}
+
 func checkSameOrigin(ctx *fasthttp.RequestCtx) bool {
 
 	origin := ctx.Request.Header.PeekBytes(originString)
@@ -1,8 +1,14 @@
 package websocket
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/valyala/fasthttp"
 )
@@ -26,3 +32,527 @@ func Test_SimpleWsServer(t *testing.T) {
 	waitGroup.Wait()
 
 }
+
+// newTestServer start the websocket server on a random local port and return the ws url
+func newTestServer(t *testing.T, wsServer *Server) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fasthttp.Server{
+		Handler: wsServer.Upgrade,
+	}
+
+	go server.Serve(ln)
+
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+
+	return "ws://" + ln.Addr().String() + "/ws"
+}
+
+// writeTestFrame write a masked frame from the client side like a browser does
+func writeTestFrame(t *testing.T, c *Client, frameType FrameTypeCode, isFin bool, payload []byte) {
+	t.Helper()
+
+	frame := newFrame()
+
+	if isFin {
+		frame.SetFin()
+	}
+
+	frame.SetFrameType(frameType)
+	frame.SetPayload(append([]byte(nil), payload...))
+	frame.SetPayloadSize(int64(len(payload)))
+	frame.SetMask()
+
+	if _, err := frame.WriteTo(c.rwBuffer); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.rwBuffer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ServerBufferAndQueueSizes(t *testing.T) {
+	type sizes struct {
+		readBuffer, writeBuffer, readQueue, writeQueue int
+	}
+
+	connSizes := make(chan sizes, 1)
+
+	wsServer := &Server{
+		ReadBufferSize:      256,
+		WriteBufferSize:     512,
+		ReadQueueSize:       4,
+		WriteQueueSize:      8,
+		UpgradeWriteTimeout: 50 * time.Millisecond,
+	}
+
+	wsServer.SetConnHandler(func(c *Conn) {
+		connSizes <- sizes{c.bufferReader.Size(), c.bufferWriter.Size(), cap(c.ReadChan), cap(c.WriteChan)}
+
+		for {
+			messageType, r, err := c.NextReader()
+
+			if err != nil {
+				return
+			}
+
+			w, _ := c.NextWriter(messageType)
+			io.Copy(w, r)
+			w.Close()
+		}
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if got := <-connSizes; got != (sizes{256, 512, 4, 8}) {
+		t.Errorf("unexpected sizes %+v", got)
+	}
+
+	// the write deadline of the 101 response is gone after the hijack
+	time.Sleep(100 * time.Millisecond)
+
+	message := bytes.Repeat([]byte("x"), 4096)
+
+	client.WriteBinary(message)
+
+	if _, data, err := client.Read(); err != nil || !bytes.Equal(data, message) {
+		t.Errorf("unexpected message of %d bytes %v", len(data), err)
+	}
+}
+
+func Test_ServerSubprotocol(t *testing.T) {
+	selected := make(chan string, 1)
+
+	wsServer := &Server{
+		Subprotocols: []string{"v2.chat", "v1.chat"},
+	}
+
+	wsServer.SetConnHandler(func(c *Conn) {
+		selected <- c.Subprotocol()
+	})
+
+	url := newTestServer(t, wsServer)
+
+	for _, tc := range []struct {
+		offered  []string
+		expected string
+	}{
+		{offered: []string{"v1.chat", "v2.chat"}, expected: "v1.chat"},
+		{offered: []string{"v3.chat", "v2.chat"}, expected: "v2.chat"},
+		{offered: []string{"v3.chat"}, expected: ""},
+		{offered: nil, expected: ""},
+	} {
+		dialer := &Dialer{HandshakeTimeout: 5 * time.Second, Subprotocols: tc.offered}
+
+		client, err := dialer.Dial(url, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if client.Subprotocol() != tc.expected || client.ResponseHeader().Get("Sec-WebSocket-Protocol") != tc.expected {
+			t.Errorf("offered %v: expected %q, got %q", tc.offered, tc.expected, client.Subprotocol())
+		}
+
+		if subprotocol := <-selected; subprotocol != tc.expected {
+			t.Errorf("offered %v: expected %q on the server, got %q", tc.offered, tc.expected, subprotocol)
+		}
+
+		client.Close()
+	}
+
+	// the callback picks among the offered subprotocols
+	wsServer.SelectSubprotocol = func(ctx *fasthttp.RequestCtx, offered []string) string {
+		return offered[len(offered)-1]
+	}
+
+	client, err := (&Dialer{HandshakeTimeout: 5 * time.Second, Subprotocols: []string{"a", "b"}}).Dial(url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if client.Subprotocol() != "b" || <-selected != "b" {
+		t.Errorf("expected the subprotocol of the callback, got %q", client.Subprotocol())
+	}
+}
+
+func Test_ServerLifecycleHooks(t *testing.T) {
+	type event struct {
+		name string
+		conn *Conn
+		code WebsocketStatusCode
+		err  error
+	}
+
+	events := make(chan event, 16)
+
+	wsServer := &Server{CloseTimeout: 100 * time.Millisecond}
+
+	wsServer.OnOpen(func(c *Conn) {
+		events <- event{name: "open", conn: c}
+	})
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		events <- event{name: "message", conn: c}
+	})
+
+	wsServer.OnError(func(c *Conn, err error) {
+		events <- event{name: "error", conn: c, err: err}
+	})
+
+	wsServer.OnClose(func(c *Conn, code WebsocketStatusCode, reason string) {
+		events <- event{name: "close", conn: c, code: code}
+	})
+
+	url := newTestServer(t, wsServer)
+
+	expectEvents := func(name string, expected ...event) {
+		t.Helper()
+
+		var conn *Conn
+
+		for _, e := range expected {
+			select {
+			case got := <-events:
+				if conn == nil {
+					conn = got.conn
+				}
+
+				if got.name != e.name || got.conn != conn || got.code != e.code || !errors.Is(got.err, e.err) {
+					t.Fatalf("%s: expected %+v, got %+v", name, e, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: %s not called", name, e.name)
+			}
+		}
+
+		select {
+		case got := <-events:
+			t.Fatalf("%s: unexpected %+v", name, got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	client, err := NewClient(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.WriteText([]byte("hello"))
+	client.Close()
+
+	expectEvents("normal close",
+		event{name: "open"},
+		event{name: "message"},
+		event{name: "close", code: WebsocketStatusCodeNormalClosure},
+	)
+
+	// the client frame must be masked
+	client, err = NewClient(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := newFrame()
+	frame.SetFin()
+	frame.SetFrameType(codeText)
+	frame.SetPayload([]byte("unmasked"))
+	frame.SetPayloadSize(8)
+	frame.WriteTo(client.rwBuffer)
+	client.rwBuffer.Flush()
+
+	expectEvents("protocol error",
+		event{name: "open"},
+		event{name: "error", err: ErrUnmaskedClientFrame},
+		event{name: "close", code: WebsocketStatusCodeAbnormalClosure},
+	)
+
+	client.c.Close()
+
+	// the client is gone without close frame
+	client, err = NewClient(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.c.Close()
+
+	expectEvents("connection lost",
+		event{name: "open"},
+		event{name: "error", err: io.EOF},
+		event{name: "close", code: WebsocketStatusCodeAbnormalClosure},
+	)
+}
+
+func Test_ServerRequestData(t *testing.T) {
+	type tenantKey struct{}
+
+	conns := make(chan *Conn, 1)
+
+	wsServer := &Server{
+		RequestHeaders: []string{"x-tenant"},
+		BeforeUpgrade: func(ctx *fasthttp.RequestCtx, locals *Locals) {
+			locals.Set(tenantKey{}, string(ctx.Request.Header.Peek("X-Tenant")))
+		},
+	}
+
+	wsServer.SetConnHandler(func(c *Conn) {
+		conns <- c
+		c.NextReader()
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			// like the path params of a router
+			ctx.SetUserValue("room", "lobby")
+			wsServer.Upgrade(ctx)
+		},
+	}
+
+	go server.Serve(ln)
+
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+
+	header := http.Header{}
+	header.Set("X-Tenant", "acme")
+	header.Set("Cookie", "session=abc")
+
+	client, err := DefaultDialer.Dial("ws://"+ln.Addr().String()+"/chat?token=secret", header)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	c := <-conns
+
+	if c.Path() != "/chat" || c.Query().Get("token") != "secret" {
+		t.Errorf("unexpected path %s and query %v", c.Path(), c.Query())
+	}
+
+	// only the selected headers are kept
+	if c.Header().Get("X-Tenant") != "acme" || len(c.Header()) != 1 {
+		t.Errorf("unexpected header %v", c.Header())
+	}
+
+	if cookies := c.Cookies(); len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Value != "abc" {
+		t.Errorf("unexpected cookies %v", cookies)
+	}
+
+	if c.RemoteAddr().String() != client.c.LocalAddr().String() || c.LocalAddr().String() != ln.Addr().String() {
+		t.Errorf("unexpected addresses %s %s", c.RemoteAddr(), c.LocalAddr())
+	}
+
+	if _, ok := c.ConnectionState(); ok {
+		t.Error("the connection is not TLS")
+	}
+
+	if tenant, ok := LocalValue[string](c.Locals(), tenantKey{}); !ok || tenant != "acme" {
+		t.Errorf("unexpected tenant %q", tenant)
+	}
+
+	if room, ok := LocalValue[string](c.Locals(), "room"); !ok || room != "lobby" {
+		t.Errorf("unexpected room %q", room)
+	}
+}
+
+func Test_ServerAuthorize(t *testing.T) {
+	errUnauthorized := errors.New("invalid token")
+
+	refused := make(chan error, 1)
+
+	wsServer := &Server{
+		Authorize: func(ctx *fasthttp.RequestCtx) (int, http.Header, error) {
+			if string(ctx.QueryArgs().Peek("token")) != "secret" {
+				ctx.Response.Header.SetContentType("application/json")
+				ctx.Response.SetBodyString(`{"error":"invalid token"}`)
+
+				return http.StatusUnauthorized, http.Header{"Www-Authenticate": {"Bearer"}}, errUnauthorized
+			}
+
+			return 0, http.Header{
+				"Set-Cookie": {"session=abc"},
+				"X-Trace-Id": {"trace-1"},
+			}, nil
+		},
+	}
+
+	wsServer.OnError(func(c *Conn, err error) {
+		if c == nil {
+			refused <- err
+		}
+	})
+
+	url := newTestServer(t, wsServer)
+
+	_, err := NewClient(url + "?token=wrong")
+
+	var handshakeErr *HandshakeError
+
+	if !errors.As(err, &handshakeErr) {
+		t.Fatalf("expected handshake error, got %v", err)
+	}
+
+	if handshakeErr.StatusCode != http.StatusUnauthorized || handshakeErr.Header.Get("WWW-Authenticate") != "Bearer" ||
+		handshakeErr.Header.Get("Content-Type") != "application/json" || string(handshakeErr.Body) != `{"error":"invalid token"}` {
+		t.Errorf("unexpected refusal %d %v %s", handshakeErr.StatusCode, handshakeErr.Header, handshakeErr.Body)
+	}
+
+	var authorizeErr *AuthorizeError
+
+	if err := <-refused; !errors.As(err, &authorizeErr) || authorizeErr.StatusCode != http.StatusUnauthorized || !errors.Is(err, errUnauthorized) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	client, err := NewClient(url + "?token=secret")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if header := client.ResponseHeader(); header.Get("X-Trace-Id") != "trace-1" || header.Get("Set-Cookie") != "session=abc" {
+		t.Errorf("unexpected response header %v", header)
+	}
+}
+
+func Test_ServerConnHandlerReturnsWithPendingFrames(t *testing.T) {
+	wsServer := &Server{ReadQueueSize: 4}
+
+	closed := make(chan struct{})
+
+	wsServer.SetConnHandler(func(c *Conn) {
+		// the handler returns after the first message, the rest is still buffered
+		c.NextReader()
+	})
+
+	wsServer.OnClose(func(c *Conn, code WebsocketStatusCode, reason string) {
+		close(closed)
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.c.Close()
+
+	for i := 0; i < 600; i++ {
+		frame := newFrame()
+		frame.SetFin()
+		frame.SetFrameType(codeText)
+		frame.SetPayload([]byte("x"))
+		frame.SetPayloadSize(1)
+		frame.SetMask()
+		frame.WriteTo(client.rwBuffer)
+	}
+
+	client.rwBuffer.Flush()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the conn with the pending frames never ended")
+	}
+}
+
+// deadlineListener record the write deadlines set on the accepted connections
+type deadlineListener struct {
+	net.Listener
+	deadlines chan time.Time
+}
+
+func (l *deadlineListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &deadlineConn{Conn: c, deadlines: l.deadlines}, nil
+}
+
+type deadlineConn struct {
+	net.Conn
+	deadlines chan time.Time
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines <- t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func Test_ServerUpgradeWriteTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadlines := make(chan time.Time, 8)
+
+	wsServer := &Server{UpgradeWriteTimeout: time.Second}
+
+	server := &fasthttp.Server{Handler: wsServer.Upgrade}
+
+	go server.Serve(&deadlineListener{Listener: ln, deadlines: deadlines})
+
+	defer server.Shutdown()
+
+	start := time.Now()
+
+	client, err := NewClient("ws://" + ln.Addr().String() + "/ws")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	// the 101 response is written under the deadline
+	if deadline := <-deadlines; deadline.Before(start.Add(time.Second)) || deadline.After(time.Now().Add(time.Second)) {
+		t.Errorf("unexpected write deadline of the 101 response %v", deadline)
+	}
+
+	// the hijacked connection has no deadline
+	select {
+	case deadline := <-deadlines:
+		if !deadline.IsZero() {
+			t.Errorf("expected the deadline cleared after the hijack, got %v", deadline)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the deadline was not cleared after the hijack")
+	}
+}
@@ -0,0 +1,316 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrWriterClosed shows up when writing on the writer of NextWriter after it is closed
+var ErrWriterClosed = errors.New("websocket: message writer is closed")
+
+// frameSource is the connection the messageReader reads the frames of a message from
+type frameSource interface {
+	// nextDataFrame return the next data frame, the control frames before it are handled
+	nextDataFrame() (*Frame, error)
+
+	// fail send the close frame with the status matching the error and end the connection
+	fail(err error)
+}
+
+// frameSink is the connection the messageWriter sends the frames of a message to
+type frameSink interface {
+	// sendFrame send a frame of the payload, the payload can be reused after return.
+	// compressed sets RSV1 on the first frame of a compressed message
+	sendFrame(frameType FrameTypeCode, payload []byte, isFin bool, compressed bool) error
+
+	// endMessage is called when the messageWriter is closed
+	endMessage()
+}
+
+// nextReader is the reader of a message returned by NextReader, the rest of
+// the message is discarded before the next message is read
+type nextReader interface {
+	io.Reader
+	discard() error
+}
+
+// newNextReader return the reader of the message starting by the frame, the compressed
+// message is inflated by the decompressor of the messageBuffer with its settings
+func newNextReader(source frameSource, frame *Frame, m *messageBuffer) (nextReader, error) {
+	compressed := frame.rsv1
+	validateUTF8 := m.validateUTF8 && frame.frameType == codeText
+
+	r, err := newMessageReader(source, frame, validateUTF8 && !compressed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if compressed {
+		return newCompressedReader(r, m.decompressor, m.readLimit, validateUTF8), nil
+	}
+
+	return r, nil
+}
+
+// messageReader is the io.Reader of a message returned by NextReader, it reads
+// the frames of the message one by one as they arrive
+type messageReader struct {
+	source frameSource
+
+	frame  *Frame
+	offset int
+
+	validateUTF8 bool
+	utf8         utf8Validator
+
+	// err is kept after the reader ends, io.EOF when the whole message was read
+	err error
+}
+
+// newMessageReader start the message by the first data frame, the frame must not be a continuation
+func newMessageReader(source frameSource, frame *Frame, validateUTF8 bool) (*messageReader, error) {
+	if frame.IsContinuation() {
+		ReleaseFrame(frame)
+		source.fail(ErrUnexpectedContinuation)
+		return nil, ErrUnexpectedContinuation
+	}
+
+	r := &messageReader{
+		source:       source,
+		validateUTF8: validateUTF8 && frame.frameType == codeText,
+	}
+
+	r.setFrame(frame)
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return r, nil
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.offset < len(r.frame.payload) {
+			n := copy(p, r.frame.payload[r.offset:])
+			r.offset += n
+			return n, nil
+		}
+
+		if r.frame.isFin {
+			r.end(io.EOF)
+			break
+		}
+
+		frame, err := r.source.nextDataFrame()
+
+		if err != nil {
+			r.end(err)
+			break
+		}
+
+		if !frame.IsContinuation() {
+			ReleaseFrame(frame)
+			r.source.fail(ErrExpectedContinuation)
+			r.end(ErrExpectedContinuation)
+			break
+		}
+
+		r.setFrame(frame)
+	}
+
+	return 0, r.err
+}
+
+// setFrame replace the current frame by the next frame of the message,
+// the text is validated before any byte of the frame is returned
+func (r *messageReader) setFrame(frame *Frame) {
+	if r.frame != nil {
+		ReleaseFrame(r.frame)
+	}
+
+	r.frame = frame
+	r.offset = 0
+
+	if r.validateUTF8 && (!r.utf8.write(frame.payload) || (frame.isFin && !r.utf8.done())) {
+		r.source.fail(errInvalidUTF8)
+		r.end(errInvalidUTF8)
+	}
+}
+
+func (r *messageReader) end(err error) {
+	r.err = err
+
+	if r.frame != nil {
+		ReleaseFrame(r.frame)
+		r.frame = nil
+	}
+}
+
+// discard drop the rest of the message, it is called before the next message is read
+func (r *messageReader) discard() error {
+	_, err := io.Copy(io.Discard, r)
+
+	return err
+}
+
+// compressedReader is the io.Reader of a compressed message returned by NextReader,
+// it inflates the message read by the messageReader as it arrives
+type compressedReader struct {
+	source frameSource
+	raw    *messageReader
+	r      io.Reader
+}
+
+// newCompressedReader inflate the message of r by the decompressor of the connection,
+// the output is limited by the read limit and the text is validated after it is inflated
+func newCompressedReader(r *messageReader, d *decompressor, readLimit int64, validateUTF8 bool) *compressedReader {
+	cr := &compressedReader{source: r.source, raw: r, r: d.newReader(r, readLimit)}
+
+	if validateUTF8 {
+		cr.r = &validateReader{r: cr.r}
+	}
+
+	return cr
+}
+
+func (r *compressedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+
+	// the errors of the frames already failed the connection in the messageReader
+	if err != nil && err != r.raw.err && isFailure(err) {
+		r.source.fail(err)
+	}
+
+	return n, err
+}
+
+// discard read the rest of the message through the decompressor, so the
+// history of the next message stays complete
+func (r *compressedReader) discard() error {
+	_, err := io.Copy(io.Discard, r)
+
+	return err
+}
+
+// messageWriter is the io.WriteCloser of a message returned by NextWriter, the
+// data is sent in frames of chunkSize and the last frame is sent by Close
+type messageWriter struct {
+	sink frameSink
+
+	frameType FrameTypeCode
+	buffer    []byte
+	chunkSize int
+
+	// compressed sets RSV1 on the first frame
+	compressed bool
+
+	closed bool
+	err    error
+}
+
+func newMessageWriter(sink frameSink, messageType FrameTypeCode, chunkSize int) *messageWriter {
+	return &messageWriter{
+		sink:      sink,
+		frameType: messageType,
+		buffer:    make([]byte, 0, chunkSize),
+		chunkSize: chunkSize,
+	}
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+
+	n := 0
+
+	for len(p) > 0 && w.err == nil {
+		// the full buffer is sent only when more data comes, the last frame is sent by Close
+		if len(w.buffer) == w.chunkSize {
+			w.flush(false)
+			continue
+		}
+
+		size := w.chunkSize - len(w.buffer)
+		if size > len(p) {
+			size = len(p)
+		}
+
+		w.buffer = append(w.buffer, p[:size]...)
+		p = p[size:]
+		n += size
+	}
+
+	return n, w.err
+}
+
+func (w *messageWriter) flush(isFin bool) {
+	w.err = w.sink.sendFrame(w.frameType, w.buffer, isFin, w.compressed)
+	w.frameType = codeContinuation
+	w.compressed = false
+	w.buffer = w.buffer[:0]
+}
+
+// Close send the last frame of the message
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	w.closed = true
+
+	if w.err == nil {
+		w.flush(true)
+	}
+
+	w.sink.endMessage()
+
+	return w.err
+}
+
+// compressedWriter is the io.WriteCloser of a compressed message returned by NextWriter,
+// the data is compressed into the messageWriter which sends the frames
+type compressedWriter struct {
+	flate io.WriteCloser
+	w     *messageWriter
+}
+
+// newCompressedWriter compress the message of w by the compressor of the connection
+func newCompressedWriter(w *messageWriter, c *compressor) (*compressedWriter, error) {
+	flate, err := c.newWriter(w)
+
+	if err != nil {
+		w.sink.endMessage()
+		return nil, err
+	}
+
+	w.compressed = true
+
+	return &compressedWriter{flate: flate, w: w}, nil
+}
+
+func (w *compressedWriter) Write(p []byte) (int, error) {
+	if w.w.closed {
+		return 0, ErrWriterClosed
+	}
+
+	return w.flate.Write(p)
+}
+
+// Close flush the compressed data and send the last frame of the message
+func (w *compressedWriter) Close() error {
+	if w.w.closed {
+		return ErrWriterClosed
+	}
+
+	err := w.flate.Close()
+
+	// the message always ends to let the other messages go
+	if closeErr := w.w.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
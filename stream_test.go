@@ -0,0 +1,154 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func Test_FrameReaderSplitBigFrame(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+
+	frame := newFrame()
+	frame.SetFin()
+	frame.SetFrameType(codeBinary)
+	frame.SetPayload(append([]byte(nil), payload...))
+	frame.SetPayloadSize(int64(len(payload)))
+	frame.SetMask()
+
+	buffer := bytes.Buffer{}
+	frame.WriteTo(&buffer)
+
+	reader := frameReader{isServer: true, readLimit: -1, chunkSize: 333}
+	message := messageBuffer{}
+
+	for i := 0; ; i++ {
+		chunk := newFrame()
+
+		if err := reader.read(&buffer, chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(chunk.payload) > 333 {
+			t.Fatalf("chunk %d is bigger than the chunk size: %d", i, len(chunk.payload))
+		}
+
+		complete, err := message.push(chunk)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if complete {
+			break
+		}
+	}
+
+	if frameType, data := message.take(); frameType != codeBinary || !bytes.Equal(data, payload) {
+		t.Errorf("unexpected message %v %d bytes", frameType, len(data))
+	}
+}
+
+func Test_StreamMessage(t *testing.T) {
+	wsServer := &Server{
+		ReadLimit: -1,
+	}
+
+	// echo every message back as a stream
+	wsServer.SetConnHandler(func(c *Conn) {
+		for {
+			messageType, r, err := c.NextReader()
+
+			if err != nil {
+				return
+			}
+
+			w, err := c.NextWriter(messageType)
+
+			if err != nil {
+				return
+			}
+
+			if _, err := io.Copy(w, r); err != nil {
+				return
+			}
+
+			if err := w.Close(); err != nil {
+				return
+			}
+		}
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	payload := bytes.Repeat([]byte("stream "), 300000)
+
+	w, err := client.NextWriter(BinaryMessage)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write in odd sizes to cross the frame boundaries
+	for data := payload; len(data) > 0; {
+		size := 7777
+		if size > len(data) {
+			size = len(data)
+		}
+
+		if _, err := w.Write(data[:size]); err != nil {
+			t.Fatal(err)
+		}
+
+		data = data[size:]
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	messageType, r, err := client.NextReader()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messageType != BinaryMessage || !bytes.Equal(data, payload) {
+		t.Errorf("unexpected message %v %d bytes", messageType, len(data))
+	}
+
+	// the rest of an unread message is dropped by the next NextReader
+	client.WriteText([]byte("first"))
+	client.WriteText([]byte("second"))
+
+	if _, _, err := client.NextReader(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err = client.NextReader()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := io.ReadAll(r); string(data) != "second" {
+		t.Errorf("expected second, got %q", data)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
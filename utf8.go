@@ -0,0 +1,79 @@
+package websocket
+
+import "unicode/utf8"
+
+// utf8Validator validate the text message incrementally, the tail of a
+// multi-byte character split between frames is kept until the next frame
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+// write validate the next part of the message and report it is still valid
+func (v *utf8Validator) write(p []byte) bool {
+	// complete the pending character by the head of p first
+	for v.n > 0 && len(p) > 0 {
+		v.pending[v.n] = p[0]
+		v.n++
+		p = p[1:]
+
+		if utf8.FullRune(v.pending[:v.n]) {
+			if r, size := utf8.DecodeRune(v.pending[:v.n]); r == utf8.RuneError && size <= 1 {
+				return false
+			}
+
+			v.n = 0
+		}
+	}
+
+	if v.n > 0 {
+		return isValidUTF8Prefix(v.pending[:v.n])
+	}
+
+	// keep the incomplete character at the end of p for the next frame
+	tail := len(p)
+	for i := len(p) - 1; i >= 0 && i > len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				tail = i
+			}
+			break
+		}
+	}
+
+	if !utf8.Valid(p[:tail]) {
+		return false
+	}
+
+	v.n = copy(v.pending[:], p[tail:])
+
+	return v.n == 0 || isValidUTF8Prefix(v.pending[:v.n])
+}
+
+// done report the whole message is valid, a pending character means the message is truncated
+func (v *utf8Validator) done() bool {
+	valid := v.n == 0
+
+	v.reset()
+
+	return valid
+}
+
+func (v *utf8Validator) reset() {
+	v.n = 0
+}
+
+// isValidUTF8Prefix report b can be completed to a valid character, padding
+// with the lowest and the highest continuation byte covers every lead byte range
+func isValidUTF8Prefix(b []byte) bool {
+	for _, fill := range [...]byte{0x80, 0xBF} {
+		buf := [utf8.UTFMax]byte{fill, fill, fill, fill}
+		copy(buf[:], b)
+
+		if r, size := utf8.DecodeRune(buf[:]); r != utf8.RuneError || size > 1 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_UTF8ValidatorSplitCharacter(t *testing.T) {
+	message := []byte("κόσμε 世界 🌍")
+
+	// every split point of the message should be accepted
+	for i := 0; i <= len(message); i++ {
+		v := utf8Validator{}
+
+		if !v.write(message[:i]) || !v.write(message[i:]) || !v.done() {
+			t.Errorf("split at %d should be valid", i)
+		}
+	}
+}
+
+func Test_UTF8ValidatorInvalid(t *testing.T) {
+	testCases := map[string][][]byte{
+		"invalid byte":         {{0xff}},
+		"truncated character":  {[]byte("hello"), {0xe4, 0xb8}},
+		"overlong encoding":    {{0xc0}, {0x80}},
+		"surrogate":            {{0xed, 0xa0}, {0x80}},
+		"out of range":         {{0xf4, 0x90}},
+		"bad continuation":     {{0xe4}, {0x41}},
+		"invalid after prefix": {[]byte("ok"), {0xe0, 0x80}},
+	}
+
+	for name, fragments := range testCases {
+		v := utf8Validator{}
+
+		valid := true
+		for _, fragment := range fragments {
+			valid = valid && v.write(fragment)
+		}
+
+		if valid && v.done() {
+			t.Errorf("%s should be invalid", name)
+		}
+	}
+}
+
+func Test_ServerCloseInvalidUTF8(t *testing.T) {
+	wsServer := &Server{}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		t.Errorf("invalid message should not reach the handler: %q", data)
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second half of a valid character is sent in the second frame
+	writeTestFrame(t, client, codeText, false, []byte{0xe4, 0xb8})
+	writeTestFrame(t, client, codeContinuation, true, []byte{0x96, 0xff})
+
+	// the connection is failed, the message after the invalid one is dropped
+	writeTestFrame(t, client, codeText, true, []byte("after the failure"))
+
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err = client.Read()
+
+	closeErr, ok := err.(*CloseError)
+
+	if !ok {
+		t.Fatalf("expected close error, got %v", err)
+	}
+
+	if closeErr.Code != WebsocketStatusCodeInvalidFramePayloadData {
+		t.Errorf("expected status %v, got %v", WebsocketStatusCodeInvalidFramePayloadData, closeErr.Code)
+	}
+}
+
+func Test_DisableUTF8Validation(t *testing.T) {
+	wsServer := &Server{DisableUTF8Validation: true}
+
+	wsServer.SetMessageHandler(func(c *Conn, isBinary bool, data []byte) {
+		c.WriteText(data)
+	})
+
+	client, err := NewClient(newTestServer(t, wsServer))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	client.DisableUTF8Validation = true
+
+	invalid := []byte{'o', 'k', 0xff}
+
+	// the server echoes the invalid text back instead of closing with 1007
+	client.WriteText(invalid)
+
+	client.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	messageType, data, err := client.Read()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if messageType != TextMessage || string(data) != string(invalid) {
+		t.Errorf("expected the invalid text %q, got %v %q", invalid, messageType, data)
+	}
+}
@@ -1,9 +1,12 @@
 package websocket
 
 import (
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"hash"
+	"net/url"
+	"strings"
 	"sync"
 )
 
@@ -33,3 +36,62 @@ func isValidChallengeKeys(s []byte) bool {
 
 	return err == nil && len(decoded) == 16
 }
+
+// generateChallengeKey return a random base64 Sec-WebSocket-Key of 16 bytes
+func generateChallengeKey() ([]byte, error) {
+	key := make([]byte, 16)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString(key)), nil
+}
+
+// basicAuth return the Basic authorization of the user info
+func basicAuth(user *url.Userinfo) string {
+	password, _ := user.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password))
+}
+
+// httpURL return the url of the websocket url with the http scheme for ws and https for wss,
+// like the proxy from the environment and the cookie jar expect
+func httpURL(u *url.URL) *url.URL {
+	scheme := "http"
+
+	if u.Scheme == "wss" {
+		scheme = "https"
+	}
+
+	return &url.URL{Scheme: scheme, Host: u.Host, Path: u.Path, RawQuery: u.RawQuery}
+}
+
+// parseSubprotocols return the subprotocols of the comma separated Sec-WebSocket-Protocol values
+func parseSubprotocols(values [][]byte) []string {
+	var subprotocols []string
+
+	for _, value := range values {
+		for _, subprotocol := range strings.Split(string(value), ",") {
+			if subprotocol = strings.TrimSpace(subprotocol); subprotocol != "" {
+				subprotocols = append(subprotocols, subprotocol)
+			}
+		}
+	}
+
+	return subprotocols
+}
+
+// containsToken tells the token is one of the tokens, the empty token is never contained
+func containsToken(tokens []string, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+
+	return false
+}